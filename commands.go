@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rexray/csi-vfs/service"
+)
+
+// command is an administrative command that is run instead of serving
+// the SP when its name is the program's first argument. Optional
+// arguments are enclosed in brackets.
+type command struct {
+	args string
+	run  func(context.Context, service.Admin, []string) error
+}
+
+var commands = map[string]command{
+	"seal": {
+		args: "VOLUME_ID",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			return a.SealVolume(ctx, args[0])
+		},
+	},
+	"create-snapshot": {
+		args: "VOLUME_ID NAME",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			snap, err := a.SnapshotVolume(ctx, args[0], args[1])
+			if err != nil {
+				return err
+			}
+			printSnapshots(snap)
+			return nil
+		},
+	},
+	"list-snapshots": {
+		args: "[VOLUME_ID]",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			var volumeID string
+			if len(args) > 0 {
+				volumeID = args[0]
+			}
+			snaps, err := a.VolumeSnapshots(ctx, volumeID)
+			if err != nil {
+				return err
+			}
+			printSnapshots(snaps...)
+			return nil
+		},
+	},
+	"expand": {
+		args: "VOLUME_ID BYTES",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid bytes: %s", args[1])
+			}
+			if n, err = a.ExpandVolume(ctx, args[0], n); err != nil {
+				return err
+			}
+			fmt.Println(n)
+			return nil
+		},
+	},
+	"refresh": {
+		args: "VOLUME_ID",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			commit, err := a.RefreshVolume(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println(commit)
+			return nil
+		},
+	},
+	"delete-snapshot": {
+		args: "SNAPSHOT_ID",
+		run: func(ctx context.Context, a service.Admin, args []string) error {
+			return a.RemoveSnapshot(ctx, args[0])
+		},
+	},
+}
+
+// runCommand runs the administrative command with the specified
+// arguments and exits the program.
+func runCommand(ctx context.Context, name string, args []string) {
+	cmd := commands[name]
+	names := strings.Fields(cmd.args)
+	required := 0
+	for _, n := range names {
+		if !strings.HasPrefix(n, "[") {
+			required++
+		}
+	}
+	if len(args) < required || len(args) > len(names) {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n",
+			path.Base(os.Args[0]), name, cmd.args)
+		os.Exit(2)
+	}
+	a, err := service.NewAdmin(ctx)
+	if err == nil {
+		err = cmd.run(ctx, a, args)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// printSnapshots prints a table of the snapshots to stdout.
+func printSnapshots(snaps ...*service.Snapshot) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVOLUME\tCREATED\tSIZE\tREADY")
+	for _, s := range snaps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\n",
+			s.ID, s.SourceVolumeID, s.CreatedAt.Format(time.RFC3339),
+			s.SizeBytes, s.Ready)
+	}
+	w.Flush()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"os"
 
 	"github.com/rexray/gocsi"
 
@@ -11,8 +12,22 @@ import (
 
 // main is ignored when this package is built as a go plug-in
 func main() {
+	// Hold a user namespace for an ID-mapped mount instead of serving the
+	// SP if the process was executed for that purpose.
+	service.RunUserNSHolder()
+
+	ctx := context.Background()
+
+	// Run an administrative command instead of serving the SP if the
+	// first argument is the name of a command.
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			runCommand(ctx, os.Args[1], os.Args[2:])
+		}
+	}
+
 	gocsi.Run(
-		context.Background(),
+		ctx,
 		service.Name,
 		"A Virtual Filesystem (VFS) Container Storage Interface (CSI) "+
 			"Storage Plug-in (SP)",
@@ -27,11 +42,30 @@ const usage = `    X_CSI_VFS_BINDFS
 
         The default value is bindfs.
 
+    X_CSI_VFS_CONTENT_ROOT
+        The path of the directory that contains the archives, OCI image
+        layouts, and git repositories used to populate new volumes. A
+        source whose path, with its symlinks resolved, is outside of the
+        directory is refused.
+
+        The default value is empty, and volumes may not be populated
+        from local paths.
+
     X_CSI_VFS_DATA
         The path to the SP's data directory.
 
         The default value is $HOME/.csi-vfs.
 
+    X_CSI_VFS_DATA_SHARED
+        A flag that indicates the data directory is deliberately shared
+        by several processes. Such processes take a shared lock on
+        $X_CSI_VFS_DATA/.owner.json, and otherwise the SP takes an
+        exclusive lock. The SP refuses to start if it cannot take its
+        lock. Required by X_CSI_VFS_LEADER_ELECTION=file and
+        X_CSI_VFS_FILE_LOCKS=true.
+
+        The default value is false.
+
     X_CSI_VFS_DEV
         The path to the SP's device directory.
 
@@ -42,6 +76,114 @@ const usage = `    X_CSI_VFS_BINDFS
 
         The default value is $X_CSI_VFS_DATA/mnt.
 
+    X_CSI_VFS_ETCD_DIAL_TIMEOUT
+        The timeout for establishing a connection to etcd when
+        X_CSI_VFS_STORE=etcd.
+
+    X_CSI_VFS_ETCD_ENDPOINTS
+        A comma-delimited list of the etcd endpoints used when
+        X_CSI_VFS_STORE=etcd.
+
+        The default value is $X_CSI_SERIAL_VOL_ACCESS_ETCD_ENDPOINTS.
+
+    X_CSI_VFS_ETCD_PREFIX
+        The prefix of the keys used when X_CSI_VFS_STORE=etcd.
+        Controllers configured with the same endpoints and prefix
+        share the same volume metadata.
+
+        The default value is /csi-vfs.
+
+    X_CSI_VFS_ETCD_REQUEST_TIMEOUT
+        The timeout of each request to etcd when X_CSI_VFS_STORE=etcd.
+        A request that times out fails with Unavailable.
+
+        The default value is 10s.
+
+    X_CSI_VFS_FILE_LOCKS
+        A flag that enables serial volume access across the processes
+        on a host that share $X_CSI_VFS_DATA. Volumes are locked with
+        flock(2) on files in $X_CSI_VFS_DATA/locks. A lock held by a
+        process that exits is released. Requires
+        X_CSI_SERIAL_VOL_ACCESS=true and honors
+        X_CSI_SERIAL_VOL_ACCESS_TIMEOUT.
+
+        The default value is false.
+
+    X_CSI_VFS_GIT
+        Specifies the path to git, a program that clones the local git
+        repositories used to populate new volumes.
+
+        The default value is git.
+
+    X_CSI_VFS_LEADER_ELECTION
+        Elects the leader of several controllers. Only the leader
+        serves CreateVolume, DeleteVolume, ControllerPublishVolume, and
+        ControllerUnpublishVolume. Valid values are "file", which locks
+        $X_CSI_VFS_DATA/leader.lock, and "etcd".
+
+        The default value is empty (disabled).
+
+    X_CSI_VFS_LEADER_ELECTION_TTL
+        The TTL of the session of an etcd leader.
+
+        The default value is 60s.
+
+    X_CSI_VFS_MAX_VOLUMES_PER_NODE
+        The maximum number of volumes ControllerPublishVolume attaches
+        to a node that has not recorded its own limit. Requests that
+        exceed the limit fail with ResourceExhausted.
+
+        The default value is 0 (no limit).
+
+    X_CSI_VFS_MOUNT_FLAGS
+        The comma-separated list of MountVolume mount flags that
+        NodePublishVolume applies to a target's bind mount. Requests
+        with other flags fail with InvalidArgument. Valid flags are ro,
+        rw, nosuid, suid, nodev, dev, noexec, exec, noatime, atime,
+        nodiratime, diratime, relatime, norelatime, strictatime, and
+        nosymfollow.
+
+        The default value is all of the valid flags except rw and
+        nosymfollow.
+
+    X_CSI_VFS_MOUNT_FLAGS_DENY
+        The comma-separated list of mount flags removed from the
+        flags allowed by X_CSI_VFS_MOUNT_FLAGS.
+
+    X_CSI_VFS_NODE_ID
+        The ID returned by NodeGetId.
+
+        The default value is the host's name.
+
+    X_CSI_VFS_NODE_MAX_VOLUMES
+        The maximum number of volumes that may be attached to the node.
+        The limit is recorded in the node's file in $X_CSI_VFS_NODES.
+
+        The default value is 0 (use $X_CSI_VFS_MAX_VOLUMES_PER_NODE).
+
+    X_CSI_VFS_NODE_TOPOLOGY
+        A comma-delimited list of key=value pairs that describe the
+        node's topology, ex. zone=a,rack=1. Volumes created with one
+        or more topology.<key> parameters may only be published to
+        nodes whose labels match the volume's topology.
+
+    X_CSI_VFS_NODES
+        The path to the SP's nodes directory. Node services record
+        their ID and topology in this directory.
+
+        The default value is $X_CSI_VFS_DATA/nodes.
+
+    X_CSI_VFS_SNAP
+        The path to the SP's snapshot directory.
+
+        The default value is $X_CSI_VFS_DATA/snap.
+
+    X_CSI_VFS_STORE
+        The store that persists the metadata of volumes and their
+        attachments. Valid values are file and etcd.
+
+        The default value is file.
+
     X_CSI_VFS_VOL
         The path to the SP's volume directory.
 
@@ -53,4 +195,10 @@ const usage = `    X_CSI_VFS_BINDFS
         volumes.
 
         The default value is *.
+
+    X_CSI_VFS_ZSTD
+        Specifies the path to zstd, a program that decompresses the
+        zstd-compressed archives used to seed new volumes.
+
+        The default value is zstd.
 `
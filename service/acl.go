@@ -0,0 +1,281 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramACL is the CreateVolume parameter that specifies the default
+	// POSIX ACL entries of the volume's root directory.
+	paramACL = "acl"
+
+	// paramXattrPrefix is the prefix of the CreateVolume parameters that
+	// specify the extended attributes of the volume's root directory.
+	paramXattrPrefix = "xattr."
+
+	// xattrUserPrefix is the prefix of the extended attributes that may
+	// be specified by CreateVolume parameters.
+	xattrUserPrefix = "user."
+
+	// xattrACLDefault is the extended attribute of a directory's default
+	// POSIX ACL.
+	xattrACLDefault = "system.posix_acl_default"
+
+	// xattrACLAccess is the extended attribute of a file's access POSIX
+	// ACL.
+	xattrACLAccess = "system.posix_acl_access"
+)
+
+// The tags and version of the POSIX ACL extended attribute format.
+const (
+	aclVersion  = 2
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+	aclNoID     = 1<<32 - 1
+)
+
+// aclEntry is an entry of a POSIX ACL.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// volumeAttrPolicy is the default POSIX ACL and the extended attributes
+// of a volume's root directory.
+type volumeAttrPolicy struct {
+	acl    []aclEntry
+	xattrs map[string]string
+}
+
+// getVolumeAttrPolicy returns the default ACL and extended attributes of
+// a volume's root directory from the CreateVolume parameters. A nil value
+// is returned if neither is specified.
+func getVolumeAttrPolicy(params map[string]string) (*volumeAttrPolicy, error) {
+	p := &volumeAttrPolicy{}
+	if v, ok := params[paramACL]; ok {
+		acl, err := parseACL(v)
+		if err != nil {
+			return nil, err
+		}
+		p.acl = acl
+	}
+	for k, v := range params {
+		if !strings.HasPrefix(k, paramXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, paramXattrPrefix)
+		if !strings.HasPrefix(name, xattrUserPrefix) ||
+			len(name) == len(xattrUserPrefix) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s: only %s* xattrs are allowed",
+				k, xattrUserPrefix)
+		}
+		if p.xattrs == nil {
+			p.xattrs = map[string]string{}
+		}
+		p.xattrs[name] = v
+	}
+	if p.acl == nil && p.xattrs == nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parseACL parses a comma or space separated list of ACL entries in the
+// short text form used by setfacl(1), ex. "u:1000:rwx g:2000:r-x". Named
+// users and groups must be numeric IDs.
+func parseACL(val string) ([]aclEntry, error) {
+	var acl []aclEntry
+	seen := map[[2]uint32]bool{}
+	for _, e := range strings.FieldsFunc(val, func(c rune) bool {
+		return c == ',' || c == ' '
+	}) {
+		f := strings.Split(e, ":")
+		if len(f) != 3 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid acl entry: %s", e)
+		}
+		entry := aclEntry{id: aclNoID}
+		named := f[1] != ""
+		switch f[0] {
+		case "u", "user":
+			entry.tag = aclUserObj
+			if named {
+				entry.tag = aclUser
+			}
+		case "g", "group":
+			entry.tag = aclGroupObj
+			if named {
+				entry.tag = aclGroup
+			}
+		case "m", "mask":
+			entry.tag = aclMask
+		case "o", "other":
+			entry.tag = aclOther
+		default:
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid acl entry: %s", e)
+		}
+		if named {
+			if entry.tag != aclUser && entry.tag != aclGroup {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"invalid acl entry: %s", e)
+			}
+			id, err := strconv.ParseUint(f[1], 10, 32)
+			if err != nil || id == aclNoID {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"invalid acl entry: %s: id must be numeric", e)
+			}
+			entry.id = uint32(id)
+		}
+		perm, ok := parseACLPerm(f[2])
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid acl entry: %s", e)
+		}
+		entry.perm = perm
+		key := [2]uint32{uint32(entry.tag), entry.id}
+		if seen[key] {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"duplicate acl entry: %s", e)
+		}
+		seen[key] = true
+		acl = append(acl, entry)
+	}
+	return acl, nil
+}
+
+// parseACLPerm parses permissions such as "rwx", "r-x", or "rw".
+func parseACLPerm(s string) (uint16, bool) {
+	if s == "" || len(s) > 3 {
+		return 0, false
+	}
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, false
+		}
+	}
+	return perm, true
+}
+
+// getAccessACL returns the entries of the root directory's access ACL
+// from the entries of the default ACL, so the named users and groups may
+// use the root directory itself. Only the named user and group entries
+// and the mask are used, since the directory's owner, owning group, and
+// other entries are its permissions. A nil value is returned if there
+// are no named entries.
+func getAccessACL(entries []aclEntry) []aclEntry {
+	var acl []aclEntry
+	named := false
+	for _, e := range entries {
+		switch e.tag {
+		case aclUser, aclGroup:
+			named = true
+			acl = append(acl, e)
+		case aclMask:
+			acl = append(acl, e)
+		}
+	}
+	if !named {
+		return nil
+	}
+	return acl
+}
+
+// completeACL returns a valid ACL from the specified entries. Missing
+// owner, owning group, and other entries are taken from the current ACL
+// or, if there is no current ACL, from the directory's mode. A missing
+// mask is the union of the permissions of the group class entries.
+func completeACL(entries, current []aclEntry, mode os.FileMode) []aclEntry {
+	base := map[uint16]uint16{
+		aclUserObj:  uint16(mode>>6) & 7,
+		aclGroupObj: uint16(mode>>3) & 7,
+		aclOther:    uint16(mode) & 7,
+	}
+	for _, e := range current {
+		if _, ok := base[e.tag]; ok {
+			base[e.tag] = e.perm
+		}
+	}
+
+	has := map[uint16]bool{}
+	acl := append([]aclEntry(nil), entries...)
+	for _, e := range acl {
+		has[e.tag] = true
+	}
+	for _, tag := range []uint16{aclUserObj, aclGroupObj, aclOther} {
+		if !has[tag] {
+			acl = append(acl, aclEntry{tag: tag, perm: base[tag], id: aclNoID})
+		}
+	}
+	if !has[aclMask] && (has[aclUser] || has[aclGroup]) {
+		var mask uint16
+		for _, e := range acl {
+			switch e.tag {
+			case aclUser, aclGroup, aclGroupObj:
+				mask |= e.perm
+			}
+		}
+		acl = append(acl, aclEntry{tag: aclMask, perm: mask, id: aclNoID})
+	}
+
+	sort.Slice(acl, func(i, j int) bool {
+		if acl[i].tag != acl[j].tag {
+			return acl[i].tag < acl[j].tag
+		}
+		return acl[i].id < acl[j].id
+	})
+	return acl
+}
+
+// encodeACL encodes the ACL in the POSIX ACL extended attribute format.
+func encodeACL(acl []aclEntry) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(aclVersion))
+	for _, e := range acl {
+		binary.Write(buf, binary.LittleEndian, e.tag)
+		binary.Write(buf, binary.LittleEndian, e.perm)
+		binary.Write(buf, binary.LittleEndian, e.id)
+	}
+	return buf.Bytes()
+}
+
+// decodeACL decodes an ACL in the POSIX ACL extended attribute format.
+// A nil value is returned if the data is not a valid ACL.
+func decodeACL(data []byte) []aclEntry {
+	if len(data) < 4 || (len(data)-4)%8 != 0 ||
+		binary.LittleEndian.Uint32(data) != aclVersion {
+		return nil
+	}
+	var acl []aclEntry
+	for i := 4; i < len(data); i += 8 {
+		acl = append(acl, aclEntry{
+			tag:  binary.LittleEndian.Uint16(data[i:]),
+			perm: binary.LittleEndian.Uint16(data[i+2:]),
+			id:   binary.LittleEndian.Uint32(data[i+4:]),
+		})
+	}
+	return acl
+}
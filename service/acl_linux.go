@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apply sets the default ACL, access ACL, and extended attributes of the
+// directory if they differ from the policy. A flag is returned that
+// indicates whether or not any of them were changed.
+func (p *volumeAttrPolicy) apply(dir string) (bool, error) {
+	changed := false
+
+	if p.acl != nil {
+		// The directory's mode is read before the access ACL is set,
+		// since a mask entry replaces the mode's group permissions.
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return false, status.Errorf(codes.Internal,
+				"failed to stat volume: %s: %v", dir, err)
+		}
+		for _, a := range []struct {
+			name    string
+			entries []aclEntry
+		}{
+			{xattrACLDefault, p.acl},
+			{xattrACLAccess, getAccessACL(p.acl)},
+		} {
+			if a.entries == nil {
+				continue
+			}
+			ok, err := setACL(dir, a.name, a.entries, fi.Mode())
+			if err != nil {
+				return false, err
+			}
+			changed = changed || ok
+		}
+	}
+
+	for name, val := range p.xattrs {
+		cur, err := getxattr(dir, name)
+		if err != nil {
+			return false, status.Errorf(codes.Internal,
+				"failed to get xattr: %s: %s: %v", dir, name, err)
+		}
+		if cur != nil && string(cur) == val {
+			continue
+		}
+		if err := syscall.Setxattr(dir, name, []byte(val), 0); err != nil {
+			return false, status.Errorf(codes.Internal,
+				"failed to set xattr: %s: %s: %v", dir, name, err)
+		}
+		changed = true
+	}
+
+	if changed {
+		log.WithField("path", dir).Debug("applied volume acl and xattrs")
+	}
+	return changed, nil
+}
+
+// setACL sets the ACL in the extended attribute of the directory if it
+// differs from the complete ACL of the entries. A flag is returned that
+// indicates whether or not the ACL was changed.
+func setACL(
+	dir, name string, entries []aclEntry, mode os.FileMode) (bool, error) {
+
+	cur, err := getxattr(dir, name)
+	if err != nil {
+		return false, status.Errorf(codes.Internal,
+			"failed to get acl: %s: %s: %v", dir, name, err)
+	}
+	acl := encodeACL(completeACL(entries, decodeACL(cur), mode))
+	if bytes.Equal(cur, acl) {
+		return false, nil
+	}
+	if err := syscall.Setxattr(dir, name, acl, 0); err != nil {
+		return false, status.Errorf(codes.Internal,
+			"failed to set acl: %s: %s: %v", dir, name, err)
+	}
+	return true, nil
+}
+
+// getxattr returns the value of the extended attribute or a nil value
+// if the attribute does not exist.
+func getxattr(path, name string) ([]byte, error) {
+	for {
+		sz, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			// The attribute grew since its size was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
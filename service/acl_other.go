@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"runtime"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apply returns a FailedPrecondition error since default ACLs and
+// extended attributes are only supported on Linux.
+func (p *volumeAttrPolicy) apply(dir string) (bool, error) {
+	return false, status.Errorf(codes.FailedPrecondition,
+		"volume acls and xattrs unsupported: %s", runtime.GOOS)
+}
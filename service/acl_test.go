@@ -0,0 +1,279 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func aclObj(tag, perm uint16) aclEntry {
+	return aclEntry{tag: tag, perm: perm, id: aclNoID}
+}
+
+func aclNamed(tag, perm uint16, id uint32) aclEntry {
+	return aclEntry{tag: tag, perm: perm, id: id}
+}
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []aclEntry
+		code codes.Code
+	}{
+		{val: ""},
+		{
+			val: "u:1000:rwx g:2000:r-x",
+			want: []aclEntry{
+				aclNamed(aclUser, 7, 1000),
+				aclNamed(aclGroup, 5, 2000),
+			},
+		},
+		{
+			val: "user::rw,group::r,mask::rx,other::-",
+			want: []aclEntry{
+				aclObj(aclUserObj, 6),
+				aclObj(aclGroupObj, 4),
+				aclObj(aclMask, 5),
+				aclObj(aclOther, 0),
+			},
+		},
+		{val: "u:1000", code: codes.InvalidArgument},
+		{val: "u:alice:rwx", code: codes.InvalidArgument},
+		{val: "u:4294967295:rwx", code: codes.InvalidArgument},
+		{val: "m:1000:rwx", code: codes.InvalidArgument},
+		{val: "o:1000:rwx", code: codes.InvalidArgument},
+		{val: "d:u:1000:rwx", code: codes.InvalidArgument},
+		{val: "x::rwx", code: codes.InvalidArgument},
+		{val: "u::rwxx", code: codes.InvalidArgument},
+		{val: "u::rws", code: codes.InvalidArgument},
+		{val: "u:1000:", code: codes.InvalidArgument},
+		{val: "u:1000:r u:1000:w", code: codes.InvalidArgument},
+		{val: "u::r user::w", code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		got, err := parseACL(tt.val)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("parseACL(%q): code %v, want %v: %v",
+				tt.val, code, tt.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseACL(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteACL(t *testing.T) {
+	tests := []struct {
+		desc    string
+		entries []aclEntry
+		current []aclEntry
+		mode    os.FileMode
+		want    []aclEntry
+	}{
+		{
+			desc: "base entries from mode",
+			mode: 0751,
+			want: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclObj(aclGroupObj, 5),
+				aclObj(aclOther, 1),
+			},
+		},
+		{
+			desc:    "named user with mask from group class",
+			entries: []aclEntry{aclNamed(aclUser, 6, 1000)},
+			mode:    0750,
+			want: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclNamed(aclUser, 6, 1000),
+				aclObj(aclGroupObj, 5),
+				aclObj(aclMask, 7),
+				aclObj(aclOther, 0),
+			},
+		},
+		{
+			desc: "explicit mask is kept",
+			entries: []aclEntry{
+				aclNamed(aclGroup, 7, 2000),
+				aclObj(aclMask, 5),
+			},
+			mode: 0700,
+			want: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclObj(aclGroupObj, 0),
+				aclNamed(aclGroup, 7, 2000),
+				aclObj(aclMask, 5),
+				aclObj(aclOther, 0),
+			},
+		},
+		{
+			desc:    "base entries from current ACL",
+			entries: []aclEntry{aclNamed(aclGroup, 4, 2000)},
+			current: []aclEntry{
+				aclObj(aclUserObj, 6),
+				aclNamed(aclUser, 7, 3000),
+				aclObj(aclGroupObj, 2),
+				aclObj(aclMask, 7),
+				aclObj(aclOther, 4),
+			},
+			mode: 0777,
+			want: []aclEntry{
+				aclObj(aclUserObj, 6),
+				aclObj(aclGroupObj, 2),
+				aclNamed(aclGroup, 4, 2000),
+				aclObj(aclMask, 6),
+				aclObj(aclOther, 4),
+			},
+		},
+		{
+			desc: "specified base entries are kept",
+			entries: []aclEntry{
+				aclObj(aclOther, 5),
+				aclObj(aclUserObj, 6),
+			},
+			mode: 0700,
+			want: []aclEntry{
+				aclObj(aclUserObj, 6),
+				aclObj(aclGroupObj, 0),
+				aclObj(aclOther, 5),
+			},
+		},
+		{
+			desc: "named entries sorted by ID",
+			entries: []aclEntry{
+				aclNamed(aclGroup, 1, 20),
+				aclNamed(aclUser, 4, 2000),
+				aclNamed(aclGroup, 2, 10),
+				aclNamed(aclUser, 4, 1000),
+			},
+			mode: 0700,
+			want: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclNamed(aclUser, 4, 1000),
+				aclNamed(aclUser, 4, 2000),
+				aclObj(aclGroupObj, 0),
+				aclNamed(aclGroup, 2, 10),
+				aclNamed(aclGroup, 1, 20),
+				aclObj(aclMask, 7),
+				aclObj(aclOther, 0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		entries := append([]aclEntry(nil), tt.entries...)
+		got := completeACL(tt.entries, tt.current, tt.mode)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+		if !reflect.DeepEqual(tt.entries, entries) {
+			t.Errorf("%s: entries modified: %v", tt.desc, tt.entries)
+		}
+	}
+}
+
+func TestEncodeACL(t *testing.T) {
+	tests := []struct {
+		desc string
+		acl  []aclEntry
+		want []byte
+	}{
+		{
+			desc: "empty",
+			want: []byte{2, 0, 0, 0},
+		},
+		{
+			desc: "entries",
+			acl: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclNamed(aclUser, 5, 1000),
+				aclObj(aclMask, 5),
+			},
+			want: []byte{
+				2, 0, 0, 0,
+				0x01, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+				0x02, 0, 5, 0, 0xe8, 0x03, 0, 0,
+				0x10, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := encodeACL(tt.acl)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.desc, got, tt.want)
+		}
+		if len(tt.acl) > 0 && !reflect.DeepEqual(decodeACL(got), tt.acl) {
+			t.Errorf("%s: decoded %v, want %v", tt.desc, decodeACL(got), tt.acl)
+		}
+	}
+}
+
+func TestDecodeACL(t *testing.T) {
+	tests := []struct {
+		desc string
+		data []byte
+		want []aclEntry
+	}{
+		{desc: "nil"},
+		{desc: "short", data: []byte{2, 0, 0}},
+		{desc: "wrong version", data: []byte{1, 0, 0, 0, 1, 0, 7, 0, 0xff, 0xff, 0xff, 0xff}},
+		{desc: "partial entry", data: []byte{2, 0, 0, 0, 1, 0, 7, 0}},
+		{
+			desc: "entry",
+			data: []byte{2, 0, 0, 0, 0x08, 0, 6, 0, 0xd0, 0x07, 0, 0},
+			want: []aclEntry{aclNamed(aclGroup, 6, 2000)},
+		},
+	}
+	for _, tt := range tests {
+		if got := decodeACL(tt.data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestGetAccessACL(t *testing.T) {
+	tests := []struct {
+		desc    string
+		entries []aclEntry
+		want    []aclEntry
+	}{
+		{desc: "empty"},
+		{
+			desc: "no named entries",
+			entries: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclObj(aclMask, 5),
+				aclObj(aclOther, 0),
+			},
+		},
+		{
+			desc: "named entries and mask",
+			entries: []aclEntry{
+				aclObj(aclUserObj, 7),
+				aclNamed(aclUser, 7, 1000),
+				aclObj(aclGroupObj, 5),
+				aclNamed(aclGroup, 5, 2000),
+				aclObj(aclMask, 5),
+				aclObj(aclOther, 0),
+			},
+			want: []aclEntry{
+				aclNamed(aclUser, 7, 1000),
+				aclNamed(aclGroup, 5, 2000),
+				aclObj(aclMask, 5),
+			},
+		},
+		{
+			desc:    "named entry without mask",
+			entries: []aclEntry{aclNamed(aclGroup, 5, 2000)},
+			want:    []aclEntry{aclNamed(aclGroup, 5, 2000)},
+		},
+	}
+	for _, tt := range tests {
+		if got := getAccessACL(tt.entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
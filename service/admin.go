@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/rexray/gocsi"
+)
+
+// Admin performs the administrative operations of the SP that are not
+// part of the CSI specification.
+type Admin interface {
+
+	// SealVolume seals a volume created with the sealable parameter.
+	SealVolume(ctx context.Context, volumeID string) error
+
+	// SnapshotVolume creates a snapshot of a volume.
+	SnapshotVolume(
+		ctx context.Context, volumeID, name string) (*Snapshot, error)
+
+	// VolumeSnapshots returns the snapshots of a volume, or all of the
+	// snapshots if the volume ID is empty.
+	VolumeSnapshots(ctx context.Context, volumeID string) ([]*Snapshot, error)
+
+	// RemoveSnapshot deletes a snapshot.
+	RemoveSnapshot(ctx context.Context, id string) error
+
+	// ExpandVolume raises the capacity of a volume and returns the
+	// volume's capacity.
+	ExpandVolume(
+		ctx context.Context, volumeID string, requiredBytes int64) (int64, error)
+
+	// RefreshVolume fast-forwards the checkout of a volume cloned from a
+	// git repository and returns the commit that is checked out.
+	RefreshVolume(ctx context.Context, volumeID string) (string, error)
+}
+
+// NewAdmin returns an Admin that operates on the data directory and
+// volume store configured by the environment in the same way as the SP.
+//
+// An Admin locks the volumes and snapshots it operates on with the same
+// file locks as the SP if serial volume access file locks are enabled,
+// so it may be used while the SP is running. Otherwise there is no lock
+// shared with the SP, so the Admin takes the data directory's exclusive
+// lock and an error is returned if the SP is running.
+func NewAdmin(ctx context.Context) (Admin, error) {
+	s := &service{}
+	if err := s.configure(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.configureNodeID(ctx); err != nil {
+		return nil, err
+	}
+	if s.hasFileLocks(ctx) {
+		return s, nil
+	}
+	if err := s.lockDataDirForAdmin(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lockDataDirForAdmin takes an exclusive lock on the data directory's
+// owner file, which every process that serves the SP holds while it
+// runs. The lock is held until the process exits.
+func (s *service) lockDataDirForAdmin() error {
+	ownerPath := path.Join(s.data, dataOwnerFileName)
+	f, err := os.OpenFile(ownerPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		return fmt.Errorf("data dir in use by the SP: %s: "+
+			"set %s=true and %s=true in the SP and the command to "+
+			"run commands while the SP is running",
+			s.data, gocsi.EnvVarSerialVolAccess, EnvVarFileLocks)
+	}
+	s.dataLock = f
+	return nil
+}
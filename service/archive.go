@@ -0,0 +1,478 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// paramArchive is the CreateVolume parameter that specifies the absolute
+// path of a local tar archive that is extracted to a new volume. The
+// archive may be compressed with gzip or zstd.
+const paramArchive = "archive"
+
+const (
+	// whiteoutPrefix is the prefix of the name of an image layer's
+	// entry that removes the file with the rest of the name from the
+	// files of earlier layers.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaque is the name of an image layer's entry that removes
+	// the files in its directory from the files of earlier layers.
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// extractArchive extracts the tar archive at the specified path, which
+// must be inside of the content root, to the directory of a new volume.
+// The total size of the archive's regular files may not exceed the
+// volume's capacity unless the capacity is zero. Extracting an archive
+// again overwrites the files extracted by an earlier attempt.
+func (s *service) extractArchive(
+	ctx context.Context, archive, volPath string, capacityBytes int64) error {
+
+	p, err := s.getContentPath(paramArchive, "archive", archive)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to open archive: %s: %v", archive, err)
+	}
+	defer f.Close()
+
+	// Remove the files of an earlier attempt so they do not count
+	// against the volume's capacity.
+	if err := clearDir(volPath, infoFileName); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to clear volume: %s: %v", volPath, err)
+	}
+	x := &tarExtractor{root: volPath, limit: capacityBytes}
+	err = s.extractStream(ctx, x, f, archive)
+	if err == nil {
+		err = x.finish()
+	}
+	if err != nil {
+		return extractError(archive, err)
+	}
+	log.WithFields(map[string]interface{}{
+		"archive": archive,
+		"path":    volPath,
+		"size":    x.size,
+	}).Info("extracted archive")
+	return nil
+}
+
+// extractStream extracts the entries of the tar stream read from r,
+// which may be compressed.
+func (s *service) extractStream(
+	ctx context.Context, x *tarExtractor, r io.Reader, name string) error {
+
+	tr, wait, err := s.decompress(ctx, r, name)
+	if err != nil {
+		return err
+	}
+	err = x.extract(tr)
+	if werr := wait(err != nil); err == nil && werr != nil {
+		err = status.Errorf(codes.InvalidArgument,
+			"failed to decompress archive: %s: %v", name, werr)
+	}
+	return err
+}
+
+// extractError returns a gRPC status error for an error that occurred
+// while an archive was extracted.
+func extractError(name string, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal,
+		"failed to extract archive: %s: %v", name, err)
+}
+
+// decompress returns a reader of the tar stream in an archive that is
+// detected by its leading bytes to be uncompressed or compressed with
+// gzip or zstd. A zstd archive is decompressed by the program specified
+// by X_CSI_VFS_ZSTD. The returned function must be called once the
+// stream is read and returns an error if decompression failed. Its
+// argument indicates whether the stream is abandoned before its end.
+func (s *service) decompress(
+	ctx context.Context,
+	r io.Reader,
+	name string) (io.Reader, func(abandon bool) error, error) {
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument,
+				"invalid gzip archive: %s: %v", name, err)
+		}
+		return zr, func(bool) error { return zr.Close() }, nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		if _, err := exec.LookPath(s.zstd); err != nil {
+			return nil, nil, status.Errorf(codes.FailedPrecondition,
+				"zstd archives require %s: %v", s.zstd, err)
+		}
+		cmd := exec.CommandContext(ctx, s.zstd, "-dcq")
+		cmd.Stdin = br
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, status.Errorf(codes.Internal,
+				"failed to start %s: %v", s.zstd, err)
+		}
+		return stdout, func(abandon bool) error {
+			if abandon {
+				cmd.Process.Kill()
+			}
+			if err := cmd.Wait(); err != nil && !abandon {
+				if msg := strings.TrimSpace(stderr.String()); msg != "" {
+					return fmt.Errorf("%v: %s", err, msg)
+				}
+				return err
+			}
+			return nil
+		}, nil
+	}
+
+	return br, func(bool) error { return nil }, nil
+}
+
+// tarExtractor extracts the entries of tar archives to a directory. An
+// entry may not be extracted outside of the directory: entry names may
+// not be absolute or contain ".." elements, and the directories in an
+// entry's path are never symlinks, which are created as they are but
+// never followed. The extractor may extract the layers of an image, in
+// which case an entry replaces the file extracted from an earlier layer
+// and whiteout entries remove the files of earlier layers.
+type tarExtractor struct {
+	root  string
+	limit int64
+	size  int64
+	dirs  []string
+	hdrs  map[string]*tar.Header
+
+	// layer records the names of the entries extracted from the current
+	// layer of an image, and their parents. Whiteout entries are only
+	// applied when it is not nil.
+	layer map[string]bool
+}
+
+// extract extracts the entries of a tar stream. Regular files, hard
+// links, symlinks, and directories are extracted, and other types of
+// entries are ignored. An entry named for the volume's info file in the
+// root of the directory is also ignored.
+func (x *tarExtractor) extract(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument,
+				"invalid archive: %v", err)
+		}
+		if err := x.extractEntry(tr, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *tarExtractor) extractEntry(r io.Reader, hdr *tar.Header) error {
+	name, err := cleanEntryName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == infoFileName {
+		return nil
+	}
+	if name == "" && hdr.Typeflag != tar.TypeDir {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid archive: root is not a directory: %s", hdr.Name)
+	}
+	if x.layer != nil {
+		if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			return x.whiteout(name)
+		}
+		for p := name; p != "."; p = path.Dir(p) {
+			x.layer[p] = true
+		}
+	}
+	target, err := x.resolve(name, true)
+	if err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fi, err := os.Lstat(target)
+		if err == nil && !fi.IsDir() {
+			err = x.remove(target)
+		}
+		if err == nil || os.IsNotExist(err) {
+			err = os.Mkdir(target, 0700)
+		}
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		if x.hdrs == nil {
+			x.hdrs = map[string]*tar.Header{}
+		}
+		if _, ok := x.hdrs[name]; !ok {
+			x.dirs = append(x.dirs, name)
+		}
+		x.hdrs[name] = hdr
+		return lchownEntry(target, hdr)
+
+	case tar.TypeReg:
+		if err := x.remove(target); err != nil {
+			return err
+		}
+		if x.limit > 0 && x.size+hdr.Size > x.limit {
+			return status.Errorf(codes.OutOfRange,
+				"archive size exceeds volume capacity: %d", x.limit)
+		}
+		w, err := os.OpenFile(target,
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, r)
+		x.size += n
+		if err != nil {
+			w.Close()
+			return status.Errorf(codes.InvalidArgument,
+				"invalid archive: %s: %v", hdr.Name, err)
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		link, err := cleanEntryName(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		src, err := x.resolve(link, false)
+		var fi os.FileInfo
+		if err == nil {
+			fi, err = os.Lstat(src)
+		}
+		if err != nil || fi.IsDir() {
+			return status.Errorf(codes.InvalidArgument,
+				"invalid archive: %s: invalid hard link: %s",
+				hdr.Name, hdr.Linkname)
+		}
+		if err := x.remove(target); err != nil {
+			return err
+		}
+		return os.Link(src, target)
+
+	case tar.TypeSymlink:
+		if err := x.remove(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return lchownEntry(target, hdr)
+
+	default:
+		return nil
+	}
+
+	if err := lchownEntry(target, hdr); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, entryMode(hdr)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// finish sets the modes and modification times of the extracted
+// directories after their contents are extracted, since a directory's
+// mode may not permit writing its contents and writing its contents
+// changes its times.
+func (x *tarExtractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		hdr := x.hdrs[x.dirs[i]]
+		target := filepath.Join(x.root, x.dirs[i])
+
+		// A directory may be removed or replaced by a later layer.
+		fi, err := os.Lstat(target)
+		if os.IsNotExist(err) || err == nil && !fi.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, entryMode(hdr)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whiteout removes the file named by a whiteout entry from the files of
+// earlier layers. An opaque whiteout entry removes the files in its
+// directory that are not extracted from the current layer.
+func (x *tarExtractor) whiteout(name string) error {
+	target, err := x.resolve(name, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir, base := path.Dir(name), path.Base(name)
+	dirPath := filepath.Dir(target)
+
+	if base == whiteoutOpaque {
+		f, err := os.Open(dirPath)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			p := path.Join(dir, n)
+			if x.layer[p] || p == infoFileName {
+				continue
+			}
+			if err := x.remove(filepath.Join(dirPath, n)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	base = strings.TrimPrefix(base, whiteoutPrefix)
+	if base == "" || base == "." {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid archive: invalid whiteout: %s", name)
+	}
+	if path.Join(dir, base) == infoFileName {
+		return nil
+	}
+	return x.remove(filepath.Join(dirPath, base))
+}
+
+// remove removes the file at the path of an entry that replaces it or
+// that is whited out, and subtracts the size of its regular files from
+// the extracted size.
+func (x *tarExtractor) remove(target string) error {
+	size, err := treeSize(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	x.size -= size
+	return nil
+}
+
+// resolve returns the path of an entry with a clean name. The
+// directories in the entry's path that do not exist are created if
+// create is true, and otherwise a not-exist error is returned. An error
+// is also returned if a file in the entry's path is not a directory.
+func (x *tarExtractor) resolve(name string, create bool) (string, error) {
+	if name == "" {
+		return x.root, nil
+	}
+	parts := strings.Split(name, "/")
+	dir := x.root
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) && create {
+			err = os.Mkdir(dir, 0755)
+		} else if err == nil && !fi.IsDir() {
+			return "", status.Errorf(codes.InvalidArgument,
+				"invalid archive: %s: path is not a directory: %s",
+				name, strings.TrimPrefix(dir, x.root+"/"))
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(x.root, name), nil
+}
+
+// cleanEntryName returns the clean name of an archive entry, which is
+// empty for the root of the archive. An error is returned if the name is
+// absolute or contains ".." elements.
+func cleanEntryName(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid archive: absolute path: %s", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", status.Errorf(codes.InvalidArgument,
+				"invalid archive: path traversal: %s", name)
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// lchownEntry sets the ownership of an extracted file to the entry's
+// owner. Ownership is not set if the process is not permitted to change
+// it.
+func lchownEntry(target string, hdr *tar.Header) error {
+	err := os.Lchown(target, hdr.Uid, hdr.Gid)
+	if os.IsPermission(err) {
+		return nil
+	}
+	return err
+}
+
+// entryMode returns the permission bits of an entry, including the
+// setuid, setgid, and sticky bits.
+func entryMode(hdr *tar.Header) os.FileMode {
+	return hdr.FileInfo().Mode() &
+		(os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
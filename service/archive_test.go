@@ -0,0 +1,604 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCode returns the gRPC code of an error, which is OK for a nil
+// error and Unknown for an error that is not a gRPC status.
+func errorCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return codes.Unknown
+}
+
+// tarEntry is an entry of a tar archive written by writeTar. The string
+// $OUT in the link name is replaced by the path of the test's directory
+// outside of the extraction root.
+type tarEntry struct {
+	name string
+	typ  byte
+	link string
+	data string
+}
+
+func file(name, data string) tarEntry {
+	return tarEntry{name: name, typ: tar.TypeReg, data: data}
+}
+
+func dir(name string) tarEntry {
+	return tarEntry{name: name, typ: tar.TypeDir}
+}
+
+func symlink(name, link string) tarEntry {
+	return tarEntry{name: name, typ: tar.TypeSymlink, link: link}
+}
+
+func hardlink(name, link string) tarEntry {
+	return tarEntry{name: name, typ: tar.TypeLink, link: link}
+}
+
+func writeTar(t *testing.T, entries []tarEntry, outside string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typ,
+			Linkname: strings.Replace(e.link, "$OUT", outside, -1),
+			Size:     int64(len(e.data)),
+			Mode:     0644,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			ModTime:  time.Unix(1500000000, 0),
+		}
+		switch e.typ {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeSymlink:
+			hdr.Mode = 0777
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestCleanEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		code codes.Code
+	}{
+		{name: "f", want: "f"},
+		{name: "d/f", want: "d/f"},
+		{name: "./d/f", want: "d/f"},
+		{name: "d//f/", want: "d/f"},
+		{name: "d/./f", want: "d/f"},
+		{name: ".", want: ""},
+		{name: "./", want: ""},
+		{name: "", want: ""},
+		{name: "..", code: codes.InvalidArgument},
+		{name: "../f", code: codes.InvalidArgument},
+		{name: "d/../f", code: codes.InvalidArgument},
+		{name: "d/../../f", code: codes.InvalidArgument},
+		{name: "d/..", code: codes.InvalidArgument},
+		{name: "/f", code: codes.InvalidArgument},
+		{name: "/", code: codes.InvalidArgument},
+		{name: "..f", want: "..f"},
+		{name: "d/f..", want: "d/f.."},
+	}
+	for _, tt := range tests {
+		got, err := cleanEntryName(tt.name)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("cleanEntryName(%q): code %v, want %v: %v",
+				tt.name, code, tt.code, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cleanEntryName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTarExtractorResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		create   bool
+		want     string
+		code     codes.Code
+		notExist bool
+		created  string
+	}{
+		{name: "", want: ""},
+		{name: "f", want: "f"},
+		{name: "d/x", want: "d/x"},
+		{name: "n/x", notExist: true},
+		{name: "n/m/x", create: true, want: "n/m/x", created: "n/m"},
+		{name: "f/x", code: codes.InvalidArgument},
+		{name: "f/x", create: true, code: codes.InvalidArgument},
+		{name: "l/x", code: codes.InvalidArgument},
+		{name: "l/x/y", create: true, code: codes.InvalidArgument},
+		{name: "d/l/x", create: true, code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		tmp, err := ioutil.TempDir("", "resolve-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		outside := filepath.Join(tmp, "outside")
+		for _, d := range []string{root + "/d", outside} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(root+"/f", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, root+"/l"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, root+"/d/l"); err != nil {
+			t.Fatal(err)
+		}
+
+		x := &tarExtractor{root: root}
+		got, err := x.resolve(tt.name, tt.create)
+		if tt.notExist {
+			if !os.IsNotExist(err) {
+				t.Errorf("resolve(%q, %v): err %v, want not exist",
+					tt.name, tt.create, err)
+			}
+			continue
+		}
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("resolve(%q, %v): code %v, want %v: %v",
+				tt.name, tt.create, code, tt.code, err)
+			continue
+		}
+		if names, _ := ioutil.ReadDir(outside); len(names) != 0 {
+			t.Errorf("resolve(%q, %v): created %s outside of root",
+				tt.name, tt.create, names[0].Name())
+		}
+		if err != nil {
+			continue
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("resolve(%q, %v) = %q, want %q",
+				tt.name, tt.create, got, want)
+		}
+		if tt.created != "" {
+			if fi, err := os.Lstat(filepath.Join(root, tt.created)); err != nil ||
+				!fi.IsDir() {
+				t.Errorf("resolve(%q, %v): %s not created: %v",
+					tt.name, tt.create, tt.created, err)
+			}
+		}
+	}
+}
+
+func TestTarExtractor(t *testing.T) {
+	tests := []struct {
+		desc string
+
+		// layers are extracted in order by the same extractor, as the
+		// layers of an image are if image is true.
+		layers [][]tarEntry
+		image  bool
+		limit  int64
+
+		// existing are the files in the root before the extraction.
+		existing map[string]string
+
+		code codes.Code
+		size int64
+
+		// files are the contents of the regular files in the root after
+		// the extraction, and links are the targets of its symlinks.
+		files  map[string]string
+		links  map[string]string
+		dirs   []string
+		absent []string
+	}{
+		{
+			desc: "files and directories",
+			layers: [][]tarEntry{{
+				dir("./"), dir("d/"), file("d/f", "abc"), file("e/g", "de"),
+			}},
+			size:  5,
+			files: map[string]string{"d/f": "abc", "e/g": "de"},
+			dirs:  []string{"d", "e"},
+		},
+		{
+			desc:   "root is not a directory",
+			layers: [][]tarEntry{{file(".", "abc")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:   "parent traversal",
+			layers: [][]tarEntry{{file("../f", "abc")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:   "nested parent traversal",
+			layers: [][]tarEntry{{dir("d/"), file("d/../../f", "abc")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:   "absolute path",
+			layers: [][]tarEntry{{file("/f", "abc")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:   "file in symlinked parent dir",
+			layers: [][]tarEntry{{symlink("l", "$OUT"), file("l/g", "abc")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc: "file in relative symlinked parent dir",
+			layers: [][]tarEntry{{
+				symlink("l", "../outside"), file("l/g", "abc"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc: "file in nested symlinked parent dir",
+			layers: [][]tarEntry{{
+				dir("d/"), symlink("d/l", "$OUT"), file("d/l/x/g", "abc"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc: "dir in symlinked parent dir",
+			layers: [][]tarEntry{{
+				symlink("l", "$OUT"), dir("l/d/"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc:   "file replaces symlink",
+			layers: [][]tarEntry{{symlink("s", "$OUT/f"), file("s", "abc")}},
+			size:   3,
+			files:  map[string]string{"s": "abc"},
+		},
+		{
+			desc: "dir replaces symlink",
+			layers: [][]tarEntry{{
+				symlink("s", "$OUT"), dir("s/"), file("s/g", "abc"),
+			}},
+			size:  3,
+			files: map[string]string{"s/g": "abc"},
+			dirs:  []string{"s"},
+		},
+		{
+			desc:   "symlinks are not followed",
+			layers: [][]tarEntry{{symlink("s", "$OUT/f")}},
+			links:  map[string]string{"s": "$OUT/f"},
+		},
+		{
+			desc:   "hard link",
+			layers: [][]tarEntry{{file("f", "abc"), hardlink("h", "f")}},
+			size:   3,
+			files:  map[string]string{"f": "abc", "h": "abc"},
+		},
+		{
+			desc: "hard link with parent traversal",
+			layers: [][]tarEntry{{
+				file("f", "abc"), hardlink("h", "../outside/f"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc:   "hard link to absolute path",
+			layers: [][]tarEntry{{hardlink("h", "$OUT/f")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc: "hard link through symlinked parent dir",
+			layers: [][]tarEntry{{
+				symlink("l", "$OUT"), hardlink("h", "l/f"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc: "hard link to symlink links the symlink",
+			layers: [][]tarEntry{{
+				symlink("l", "$OUT/f"), hardlink("h", "l"),
+			}},
+			links: map[string]string{"l": "$OUT/f", "h": "$OUT/f"},
+		},
+		{
+			desc: "hard link in symlinked parent dir",
+			layers: [][]tarEntry{{
+				file("f", "abc"), symlink("l", "$OUT"), hardlink("l/h", "f"),
+			}},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc:   "hard link to missing file",
+			layers: [][]tarEntry{{hardlink("h", "f")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:   "hard link to dir",
+			layers: [][]tarEntry{{dir("d/"), hardlink("h", "d")}},
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:     "info file is ignored",
+			layers:   [][]tarEntry{{file(infoFileName, "abc")}},
+			existing: map[string]string{infoFileName: "{}"},
+			files:    map[string]string{infoFileName: "{}"},
+		},
+		{
+			desc:   "capacity exceeded",
+			layers: [][]tarEntry{{file("a", "abc"), file("b", "abc")}},
+			limit:  5,
+			code:   codes.OutOfRange,
+		},
+		{
+			desc:   "capacity reached",
+			layers: [][]tarEntry{{file("a", "abc"), file("b", "abc")}},
+			limit:  6,
+			size:   6,
+			files:  map[string]string{"a": "abc", "b": "abc"},
+		},
+		{
+			desc:   "replaced file does not count against capacity",
+			layers: [][]tarEntry{{file("a", "abc"), file("a", "abcd")}},
+			limit:  5,
+			size:   4,
+			files:  map[string]string{"a": "abcd"},
+		},
+		{
+			desc: "replaced dir does not count against capacity",
+			layers: [][]tarEntry{{
+				file("d/a", "abc"), file("d/b", "abc"), file("d", "abcd"),
+			}},
+			limit: 7,
+			size:  4,
+			files: map[string]string{"d": "abcd"},
+		},
+		{
+			desc:   "zero capacity is unlimited",
+			layers: [][]tarEntry{{file("a", "abc"), file("b", "abc")}},
+			size:   6,
+		},
+		{
+			desc:   "whiteouts are files in archives",
+			layers: [][]tarEntry{{file("a", "abc"), file(".wh.a", "")}},
+			size:   3,
+			files:  map[string]string{"a": "abc", ".wh.a": ""},
+		},
+		{
+			desc: "whiteout",
+			layers: [][]tarEntry{
+				{file("a", "abc"), file("d/b", "de")},
+				{file(".wh.a", ""), file("d/.wh.b", "")},
+			},
+			image:  true,
+			absent: []string{"a", ".wh.a", "d/b", "d/.wh.b"},
+			dirs:   []string{"d"},
+		},
+		{
+			desc: "whiteout of dir",
+			layers: [][]tarEntry{
+				{file("d/a", "abc"), file("d/e/b", "de"), file("c", "f")},
+				{file(".wh.d", "")},
+			},
+			image:  true,
+			size:   1,
+			absent: []string{"d"},
+			files:  map[string]string{"c": "f"},
+		},
+		{
+			desc: "whiteout of missing file",
+			layers: [][]tarEntry{
+				{file("a", "abc")},
+				{file(".wh.b", ""), file("n/.wh.b", "")},
+			},
+			image:  true,
+			size:   3,
+			files:  map[string]string{"a": "abc"},
+			absent: []string{"n"},
+		},
+		{
+			desc: "whiteout of symlink removes the symlink",
+			layers: [][]tarEntry{
+				{symlink("s", "$OUT/f"), symlink("l", "$OUT")},
+				{file(".wh.s", ""), file(".wh.l", "")},
+			},
+			image:  true,
+			absent: []string{"s", "l"},
+		},
+		{
+			desc: "whiteout in symlinked parent dir",
+			layers: [][]tarEntry{
+				{symlink("l", "$OUT")},
+				{file("l/.wh.f", "")},
+			},
+			image: true,
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc: "opaque whiteout in symlinked parent dir",
+			layers: [][]tarEntry{
+				{symlink("l", "$OUT")},
+				{file("l/"+whiteoutOpaque, "")},
+			},
+			image: true,
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc: "whiteout with parent traversal",
+			layers: [][]tarEntry{
+				{file("a", "abc")},
+				{file("../outside/.wh.f", "")},
+			},
+			image: true,
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:   "whiteout without name",
+			layers: [][]tarEntry{{file(whiteoutPrefix, "")}},
+			image:  true,
+			code:   codes.InvalidArgument,
+		},
+		{
+			desc:     "whiteout of info file is ignored",
+			layers:   [][]tarEntry{{file(".wh."+infoFileName, "")}},
+			image:    true,
+			existing: map[string]string{infoFileName: "{}"},
+			files:    map[string]string{infoFileName: "{}"},
+		},
+		{
+			desc: "opaque whiteout",
+			layers: [][]tarEntry{
+				{file("d/a", "abc"), file("d/e/b", "de"), file("c", "f")},
+				{file("d/g", "hi"), file("d/"+whiteoutOpaque, "")},
+			},
+			image:  true,
+			size:   3,
+			files:  map[string]string{"c": "f", "d/g": "hi"},
+			absent: []string{"d/a", "d/e", "d/" + whiteoutOpaque},
+		},
+		{
+			desc: "opaque whiteout of root keeps info file",
+			layers: [][]tarEntry{
+				{file("a", "abc")},
+				{file(whiteoutOpaque, "")},
+			},
+			image:    true,
+			existing: map[string]string{infoFileName: "{}"},
+			files:    map[string]string{infoFileName: "{}"},
+			absent:   []string{"a"},
+		},
+		{
+			desc: "whiteout frees capacity",
+			layers: [][]tarEntry{
+				{file("a", "abc")},
+				{file(".wh.a", ""), file("b", "abcd")},
+			},
+			image: true,
+			limit: 5,
+			size:  4,
+			files: map[string]string{"b": "abcd"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "extract-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			root := filepath.Join(tmp, "root")
+			outside := filepath.Join(tmp, "outside")
+			for _, d := range []string{root, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			secret := filepath.Join(outside, "f")
+			if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range tt.existing {
+				p := filepath.Join(root, name)
+				if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			x := &tarExtractor{root: root, limit: tt.limit}
+			for _, entries := range tt.layers {
+				if tt.image {
+					x.layer = map[string]bool{}
+				}
+				if err = x.extract(writeTar(t, entries, outside)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = x.finish()
+			}
+
+			// Nothing outside of the root may be changed or linked.
+			names, _ := ioutil.ReadDir(outside)
+			if len(names) != 1 {
+				t.Errorf("files outside of root: %d, want 1", len(names))
+			}
+			if buf, err := ioutil.ReadFile(secret); err != nil ||
+				string(buf) != "secret" {
+				t.Errorf("file outside of root changed: %q: %v", buf, err)
+			}
+			if fi, err := os.Stat(secret); err == nil &&
+				fi.Sys().(*syscall.Stat_t).Nlink != 1 {
+				t.Errorf("file outside of root hard linked")
+			}
+
+			if code := errorCode(err); code != tt.code {
+				t.Fatalf("code %v, want %v: %v", code, tt.code, err)
+			}
+			if err != nil {
+				return
+			}
+			if x.size != tt.size {
+				t.Errorf("size %d, want %d", x.size, tt.size)
+			}
+			for name, want := range tt.files {
+				p := filepath.Join(root, name)
+				if fi, err := os.Lstat(p); err != nil || !fi.Mode().IsRegular() {
+					t.Errorf("%s: not a regular file: %v", name, err)
+					continue
+				}
+				if buf, _ := ioutil.ReadFile(p); string(buf) != want {
+					t.Errorf("%s: %q, want %q", name, buf, want)
+				}
+			}
+			for name, want := range tt.links {
+				want = strings.Replace(want, "$OUT", outside, -1)
+				if got, err := os.Readlink(filepath.Join(root, name)); err != nil ||
+					got != want {
+					t.Errorf("%s: link %q, want %q: %v", name, got, want, err)
+				}
+			}
+			for _, name := range tt.dirs {
+				if fi, err := os.Lstat(filepath.Join(root, name)); err != nil ||
+					!fi.IsDir() {
+					t.Errorf("%s: not a directory: %v", name, err)
+				}
+			}
+			for _, name := range tt.absent {
+				if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+					t.Errorf("%s: exists: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package service
+
+// attachmentInfo is the record persisted by ControllerPublishVolume
+// when a volume is attached to a node.
+type attachmentInfo struct {
+	VolumeID string `json:"volume_id"`
+	NodeID   string `json:"node_id"`
+	Readonly bool   `json:"readonly,omitempty"`
+	DevPath  string `json:"dev_path,omitempty"`
+}
+
+// getMaxVolumes returns the maximum number of volumes that may be
+// attached to a node. The limit recorded by the node takes precedence
+// over the controller's default. A value of zero means no limit.
+func (s *service) getMaxVolumes(node *nodeInfo) int {
+	if node != nil && node.MaxVolumes > 0 {
+		return node.MaxVolumes
+	}
+	return s.maxVolumesPerNode
+}
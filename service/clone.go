@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramSourceVolume is the CreateVolume parameter that specifies the
+	// ID of the volume whose contents are copied to a new volume.
+	paramSourceVolume = "sourceVolume"
+
+	// cloneWait is how long CreateVolume waits for a clone to complete
+	// before it reports the clone's progress.
+	cloneWait = 2 * time.Second
+)
+
+// cloneInfo is the state of the copy of a source volume's contents to a
+// new volume. It is persisted with the volume's record by the volume
+// store until the copy completes, so an interrupted copy is started
+// again by the next request for the volume.
+type cloneInfo struct {
+	Source string `json:"source"`
+	Total  int64  `json:"total"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cloneCopy is a copy of a source volume's contents that is running in
+// this process. The copy is cancelled if this process stops being the
+// leader.
+type cloneCopy struct {
+	total  int64
+	copied int64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newCloneInfo returns the state of a new copy of the contents of the
+// source volume to the new volume. An error is returned if the source
+// volume may not be cloned to the new volume.
+func (s *service) newCloneInfo(
+	ctx context.Context, vol *volumeInfo) (*cloneInfo, error) {
+
+	source := vol.Parameters[paramSourceVolume]
+	src, err := s.getVolume(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted, _ := isEncrypted(src.Parameters); encrypted {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"clones of encrypted volumes unsupported: %s", source)
+	}
+	total, err := treeSize(src.path, infoFileName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to get size of volume: %s: %v", source, err)
+	}
+	if cr := vol.CapacityRange; cr != nil &&
+		cr.LimitBytes > 0 && total > cr.LimitBytes {
+		return nil, status.Errorf(codes.OutOfRange,
+			"source volume size exceeds limit bytes: %d", total)
+	}
+	return &cloneInfo{Source: source, Total: total}, nil
+}
+
+// cloneVolume copies the contents of the source volume to the directory
+// of a volume whose record has the state of the copy. The copy is
+// started by the first request for the volume and continues after the
+// request returns, so a retried request reports the copy's progress with
+// an Aborted error instead of starting the copy again. A copy that is
+// not running in this process, because it failed or was interrupted,
+// is started again after the volume's directory is cleared. The record
+// of the volume is returned once the copy completes.
+func (s *service) cloneVolume(
+	ctx context.Context, vol *volumeInfo) (*volumeInfo, error) {
+
+	s.cloneL.Lock()
+	c := s.clones[vol.Name]
+	if c == nil {
+		// The request that observes a failed copy reports the error and
+		// clears it, so the copy is started again by the next request.
+		if vol.clone.Error != "" {
+			s.cloneL.Unlock()
+			msg := vol.clone.Error
+			vol.clone.Error = ""
+			if err := s.store.saveVolume(ctx, vol); err != nil {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.Internal,
+				"failed to clone volume: %s: %s", vol.clone.Source, msg)
+		}
+		var err error
+		if c, err = s.startClone(ctx, vol); err != nil {
+			s.cloneL.Unlock()
+			return nil, err
+		}
+	}
+	s.cloneL.Unlock()
+
+	t := time.NewTimer(cloneWait)
+	defer t.Stop()
+	select {
+	case <-c.done:
+	case <-t.C:
+		return nil, c.progress()
+	case <-ctx.Done():
+		return nil, c.progress()
+	}
+
+	// The outcome of the copy is recorded by the volume store.
+	if vol, err := s.getVolume(ctx, vol.Name); err != nil || vol.clone == nil {
+		return vol, err
+	}
+	return nil, status.Errorf(codes.Aborted,
+		"clone interrupted: %s", vol.Name)
+}
+
+// startClone clears the directory of the volume and starts the copy of
+// the source volume's contents to it. The caller must hold cloneL.
+func (s *service) startClone(
+	ctx context.Context, vol *volumeInfo) (*cloneCopy, error) {
+
+	src, err := s.getVolume(ctx, vol.clone.Source)
+	if err != nil {
+		return nil, err
+	}
+	if err := clearDir(vol.path, infoFileName); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to clear volume: %s: %v", vol.Name, err)
+	}
+
+	copyCtx, cancel := s.leaderContext()
+	c := &cloneCopy{
+		total:  vol.clone.Total,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if s.clones == nil {
+		s.clones = map[string]*cloneCopy{}
+	}
+	s.clones[vol.Name] = c
+	go s.runClone(copyCtx, c, vol, src.path)
+
+	log.WithFields(map[string]interface{}{
+		"volume": vol.Name,
+		"source": vol.clone.Source,
+		"size":   vol.clone.Total,
+	}).Info("started volume clone")
+	return c, nil
+}
+
+// runClone copies the contents of the source volume and records the
+// outcome of the copy with the volume's record. The ownership and
+// attributes of the volume's root directory are applied after the copy
+// since the copy replaces them. A copy that is cancelled is not
+// recorded since this process is no longer the leader.
+func (s *service) runClone(
+	ctx context.Context, c *cloneCopy, vol *volumeInfo, srcPath string) {
+
+	defer func() {
+		s.cloneL.Lock()
+		if s.clones[vol.Name] == c {
+			delete(s.clones, vol.Name)
+		}
+		s.cloneL.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+
+	fields := map[string]interface{}{
+		"volume": vol.Name,
+		"source": vol.clone.Source,
+	}
+	_, err := copyTree(ctx, srcPath, vol.path, &c.copied, infoFileName)
+	if err == nil {
+		err = applyRootPolicy(vol)
+	}
+	if ctx.Err() != nil {
+		log.WithFields(fields).Warn("cancelled volume clone")
+		return
+	}
+	if err != nil {
+		vol.clone.Error = err.Error()
+	} else {
+		vol.clone = nil
+	}
+	if err := s.store.saveVolume(ctx, vol); err != nil {
+		log.WithFields(fields).WithError(err).Error(
+			"failed to record volume clone")
+		return
+	}
+	if vol.clone != nil {
+		log.WithFields(fields).WithError(err).Error("failed to clone volume")
+		return
+	}
+	log.WithFields(fields).Info("cloned volume")
+}
+
+// applyRootPolicy applies the ownership, permissions, default ACL, and
+// extended attributes of the volume's root directory from the volume's
+// parameters.
+func applyRootPolicy(vol *volumeInfo) error {
+	owner, err := getVolumeOwnership(vol.Parameters)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := owner.apply(vol.path); err != nil {
+			return err
+		}
+	}
+	attrs, err := getVolumeAttrPolicy(vol.Parameters)
+	if err != nil {
+		return err
+	}
+	if attrs != nil {
+		if _, err := attrs.apply(vol.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isCloneRunning returns a flag that indicates whether or not the
+// contents of the volume with the specified name are being copied by
+// this process.
+func (s *service) isCloneRunning(name string) bool {
+	s.cloneL.Lock()
+	defer s.cloneL.Unlock()
+	_, ok := s.clones[name]
+	return ok
+}
+
+// checkNotCloning returns a FailedPrecondition error if the volume's
+// contents are still being copied from its source volume.
+func checkNotCloning(vol *volumeInfo) error {
+	if vol.clone != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"volume is being cloned: %s", vol.Name)
+	}
+	return nil
+}
+
+// progress returns an Aborted error that reports the copy's progress.
+func (c *cloneCopy) progress() error {
+	copied := atomic.LoadInt64(&c.copied)
+	pct := int64(100)
+	if c.total > 0 {
+		pct = copied * 100 / c.total
+	}
+	return status.Errorf(codes.Aborted,
+		"clone in progress: %d of %d bytes copied (%d%%)",
+		copied, c.total, pct)
+}
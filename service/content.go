@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// contentParams are the CreateVolume parameters that specify the source
+// of a new volume's initial contents.
+var contentParams = []string{
+	paramSnapshot,
+	paramSourceVolume,
+	paramArchive,
+	paramOCILayout,
+	paramGitRepo,
+}
+
+// contentOptions are the CreateVolume parameters that are options of a
+// content parameter, mapped to that parameter.
+var contentOptions = map[string]string{
+	paramOCIRef: paramOCILayout,
+	paramGitRef: paramGitRepo,
+}
+
+// getContentParam returns the name of the CreateVolume parameter that
+// specifies the source of a new volume's initial contents. An empty
+// string is returned if there is no such parameter. An InvalidArgument
+// error is returned if more than one source is specified, or if an
+// option of a content parameter is specified without the parameter.
+func getContentParam(params map[string]string) (string, error) {
+	var names []string
+	for _, name := range contentParams {
+		if _, ok := params[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 1 {
+		sort.Strings(names)
+		return "", status.Errorf(codes.InvalidArgument,
+			"param %s conflicts with %s", names[0], names[1])
+	}
+	for opt, name := range contentOptions {
+		if _, ok := params[opt]; ok && (len(names) == 0 || names[0] != name) {
+			return "", status.Errorf(codes.InvalidArgument,
+				"param %s requires %s", opt, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	return names[0], nil
+}
+
+// populateVolume copies the initial contents of a new volume from the
+// source specified by the volume's parameters, if any. The contents of a
+// volume's clone are copied by cloneVolume instead.
+func (s *service) populateVolume(ctx context.Context, vol *volumeInfo) error {
+	name, err := getContentParam(vol.Parameters)
+	if err != nil || name == "" {
+		return err
+	}
+	val := vol.Parameters[name]
+
+	switch name {
+	case paramSnapshot:
+		return s.restoreSnapshot(ctx, val, vol.path, vol.capacityBytes)
+	case paramArchive:
+		return s.extractArchive(ctx, val, vol.path, vol.capacityBytes)
+	case paramOCILayout:
+		return s.extractImage(ctx, val, vol.Parameters[paramOCIRef],
+			vol.path, vol.capacityBytes)
+	case paramGitRepo:
+		return s.cloneRepo(ctx, vol)
+	}
+	return nil
+}
+
+// getContentPath returns the path of the local source of a new volume's
+// contents that is specified by the CreateVolume parameter, with its
+// symlinks resolved. The source must be inside of the content root so
+// that a request may not read arbitrary files of the controller's host.
+// A FailedPrecondition error is returned if there is no content root, an
+// InvalidArgument error if the path is not absolute or is outside of the
+// content root, and a NotFound error if the path does not exist.
+func (s *service) getContentPath(param, kind, p string) (string, error) {
+	if s.contentRoot == "" {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"param %s requires %s", param, EnvVarContentRoot)
+	}
+	if !path.IsAbs(p) {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid param: %s: path must be absolute: %s", param, p)
+	}
+	r, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", status.Errorf(codes.NotFound, "%s: %s", kind, p)
+		}
+		return "", status.Errorf(codes.Internal,
+			"failed to resolve %s: %s: %v", kind, p, err)
+	}
+	if !isPathWithin(s.contentRoot, r) {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid param: %s: path outside of content root: %s", param, p)
+	}
+	return r, nil
+}
+
+// isPathWithin returns a flag that indicates whether or not the path is
+// the root directory or inside of it. Both paths must be clean.
+func isPathWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator)) &&
+		!filepath.IsAbs(rel)
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestIsPathWithin(t *testing.T) {
+	tests := []struct {
+		root string
+		path string
+		want bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/a/b/c", true},
+		{"/a", "/a/..b", true},
+		{"/a", "/", false},
+		{"/a", "/ab", false},
+		{"/a", "/b", false},
+		{"/a/b", "/a", false},
+		{"/a/b", "/a/c/b", false},
+		{"/", "/a", true},
+	}
+	for _, tt := range tests {
+		if got := isPathWithin(tt.root, tt.path); got != tt.want {
+			t.Errorf("isPathWithin(%q, %q) = %v, want %v",
+				tt.root, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGetContentPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "content-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if tmp, err = filepath.EvalSymlinks(tmp); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+	for _, d := range []string{root + "/d", outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{root + "/d/f", outside + "/f"} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		root + "/in":      "d/f",
+		root + "/out":     outside + "/f",
+		root + "/outdir":  outside,
+		root + "/dangle":  "missing",
+		outside + "/root": root + "/d",
+	}
+	for name, link := range links {
+		if err := os.Symlink(link, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		root string
+		path string
+		want string
+		code codes.Code
+	}{
+		{root: root, path: root + "/d/f", want: root + "/d/f"},
+		{root: root, path: root + "/d", want: root + "/d"},
+		{root: root, path: root, want: root},
+		{root: root, path: root + "/in", want: root + "/d/f"},
+		{root: root, path: root + "/d/../d/f", want: root + "/d/f"},
+		{root: root, path: outside + "/root/f", want: root + "/d/f"},
+		{root: root, path: outside + "/f", code: codes.InvalidArgument},
+		{root: root, path: root + "/../outside/f", code: codes.InvalidArgument},
+		{root: root, path: root + "/out", code: codes.InvalidArgument},
+		{root: root, path: root + "/outdir/f", code: codes.InvalidArgument},
+		{root: root, path: "d/f", code: codes.InvalidArgument},
+		{root: root, path: root + "/missing", code: codes.NotFound},
+		{root: root, path: root + "/dangle", code: codes.NotFound},
+		{root: "", path: root + "/d/f", code: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		s := &service{contentRoot: tt.root}
+		got, err := s.getContentPath(paramArchive, "archive", tt.path)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("getContentPath(%q): code %v, want %v: %v",
+				tt.path, code, tt.code, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getContentPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"math/rand"
 	"os"
 	"path"
-	"path/filepath"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/akutz/gofsutil"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csiutils "github.com/rexray/gocsi/utils"
 )
@@ -20,6 +19,67 @@ func (s *service) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
+	// Validate the ownership, permissions, default ACL, and extended
+	// attributes of the volume's root directory.
+	if _, err := getVolumeOwnership(req.Parameters); err != nil {
+		return nil, err
+	}
+	if _, err := getVolumeAttrPolicy(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	// Validate the volume's sealing policy.
+	if _, err := getSealPolicy(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	// Validate the policy applied to the volume's subdirectories.
+	if _, err := getSubdirPolicy(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	// Validate the files of a projected volume, which has no other
+	// contents.
+	projected, err := isProjected(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getProjectedFiles(req.Parameters); err != nil {
+		return nil, err
+	}
+	if projected {
+		names := []string{paramEncrypted}
+		for _, name := range append(names, contentParams...) {
+			if _, ok := req.Parameters[name]; ok {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"param %s conflicts with %s", name, paramProjected)
+			}
+		}
+	}
+
+	// Get the key of an encrypted volume. The key must be the key that
+	// is given to NodePublishVolume, since it is only used to derive the
+	// identifier of the key in the volume's encryption policy.
+	var key []byte
+	encrypted, err := isEncrypted(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	contentParam, err := getContentParam(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if contentParam != "" {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"param %s conflicts with %s", contentParam, paramEncrypted)
+		}
+		if key, err = getEncryptionKey(
+			req.ControllerCreateCredentials); err != nil {
+			return nil, err
+		}
+	}
+
 	// Get the path to the volume directory and create it if necessary.
 	volPath := path.Join(s.vol, req.Name)
 	if ok, err := fileExists(volPath); !ok {
@@ -33,52 +93,112 @@ func (s *service) CreateVolume(
 		}
 	}
 
-	// Get the path to the volume's info file.
-	volInfoPath := path.Join(volPath, infoFileName)
-	if ok, err := fileExists(volInfoPath); !ok {
-		if err != nil {
-			return nil, status.Errorf(
-				codes.NotFound, "%s: %v", volInfoPath, err)
-		}
+	// Lock the requested name so that only one request copies the
+	// contents of a new volume to its directory before the volume is
+	// created. A concurrent request waits for the lock and then validates
+	// the volume created by the request that held it.
+	unlock, err := s.lockVolumeName(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Get the ID of an existing volume with the requested name.
+	volID, err := s.store.getVolumeID(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
 
-		// Assign the volume info structure that is marshaled to disk.
-		vol := volumeInfo{
+	var vol *volumeInfo
+	if volID == "" {
+
+		// Assign the volume info structure that is persisted by the
+		// volume store. The volume's accessible topology is recorded
+		// from the request's "topology." parameters.
+		newVol := &volumeInfo{
 			CreateVolumeRequest: *req,
+			accessibleTopology:  getTopologyParams(req.Parameters),
 			path:                volPath,
-			infoPath:            volInfoPath,
 		}
 
 		// Figure out the volume's capacity.
-		if cr := vol.CapacityRange; cr != nil {
+		if cr := newVol.CapacityRange; cr != nil {
 			if cr.RequiredBytes == cr.LimitBytes {
-				vol.capacityBytes = cr.RequiredBytes
+				newVol.capacityBytes = cr.RequiredBytes
 			} else {
 				// Generate a random size that is somewhere between the min
 				// and max limits provided by the request.
-				vol.capacityBytes = rand.Int63n(cr.LimitBytes) +
+				newVol.capacityBytes = rand.Int63n(cr.LimitBytes) +
 					cr.RequiredBytes
 			}
 		}
 
-		// Save the volume info to disk.
-		if err := vol.save(); err != nil {
+		// Copy the initial contents of a new volume from the snapshot,
+		// archive, or other source in the request's parameters. A retried
+		// request copies the contents again. The contents of a volume's
+		// clone are copied after the volume is created, with the state of
+		// the copy recorded by the volume store.
+		if contentParam == paramSourceVolume {
+			if newVol.clone, err = s.newCloneInfo(ctx, newVol); err != nil {
+				return nil, err
+			}
+		} else if err := s.populateVolume(ctx, newVol); err != nil {
 			return nil, err
 		}
 
-		return &csi.CreateVolumeResponse{
-			Volume: vol.toCSIVolInfo(),
-		}, nil
-	}
+		// Set the encryption policy of a new volume's directory while it
+		// is empty. Setting the same policy again succeeds, so a retried
+		// request does not fail.
+		if key != nil {
+			if err := setEncryptionPolicy(volPath, getKeyID(key)); err != nil {
+				return nil, err
+			}
+		}
 
-	// Create a new volumeInfo object and try to unmarshal its contents
-	// from disk.
-	vol := &volumeInfo{path: volPath, infoPath: volInfoPath}
-	if err := vol.load(); err != nil {
-		return nil, err
+		// Apply the ownership, permissions, default ACL, and extended
+		// attributes of the root directory after its contents are copied,
+		// since the copy replaces them, and before the volume is created,
+		// so the volume is never visible without them. A retried request
+		// applies them again. They are applied to a clone once its copy
+		// completes.
+		if newVol.clone == nil {
+			if err := applyRootPolicy(newVol); err != nil {
+				return nil, err
+			}
+		}
+
+		// Atomically create the volume in the volume store. If another
+		// request created a volume with the same name first then the
+		// existing volume is validated against this request.
+		if vol, err = s.store.createVolume(ctx, newVol); err != nil {
+			return nil, err
+		}
+		if vol == nil {
+			if newVol.clone != nil {
+				if newVol, err = s.cloneVolume(ctx, newVol); err != nil {
+					return nil, err
+				}
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: newVol.toCSIVolInfo(),
+			}, nil
+		}
+	} else {
+
+		// Get the existing volume from the volume store.
+		if vol, err = s.getVolume(ctx, volID); err != nil {
+			return nil, err
+		}
 	}
 
-	// Validate request capacity range against existing size.
-	if cr := req.CapacityRange; cr != nil {
+	// Validate request capacity range against existing size. A volume
+	// is only expanded by ExpandVolume, so a request with the capacity
+	// range of the request that created the volume is a retry of that
+	// request, which is not compared against an expanded capacity.
+	cr, orig := req.CapacityRange, vol.CapacityRange
+	if cr != nil && (orig == nil ||
+		cr.RequiredBytes != orig.RequiredBytes ||
+		cr.LimitBytes != orig.LimitBytes) {
 		if vol.capacityBytes < cr.RequiredBytes {
 			return nil, status.Errorf(
 				codes.AlreadyExists,
@@ -116,6 +236,13 @@ func (s *service) CreateVolume(
 			"requested capabilities incompatible w existing")
 	}
 
+	// Continue the copy of the contents of an existing volume's clone.
+	if vol.clone != nil {
+		if vol, err = s.cloneVolume(ctx, vol); err != nil {
+			return nil, err
+		}
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: vol.toCSIVolInfo(),
 	}, nil
@@ -132,12 +259,48 @@ func (s *service) DeleteVolume(
 		return nil, status.Errorf(codes.NotFound, "%s: %v", volPath, err)
 	}
 
+	// A volume may not be deleted while it is being cloned.
+	if s.isCloneRunning(req.VolumeId) {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume is being cloned: %s", req.VolumeId)
+	}
+
+	// A sealed volume may not be deleted until its retention period
+	// has passed.
+	vol, err := s.store.getVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		if err := unsealForDelete(vol); err != nil {
+			return nil, err
+		}
+	}
+
 	// Attempt to delete the "volume".
 	if err := os.RemoveAll(volPath); err != nil {
 		return nil, status.Errorf(
 			codes.Internal, "delete failed: %s: %v", volPath, err)
 	}
 
+	// Remove the git directory of a volume cloned from a git repository.
+	gitDir := s.getGitDir(req.VolumeId)
+	if err := os.RemoveAll(gitDir); err != nil {
+		return nil, status.Errorf(
+			codes.Internal, "delete failed: %s: %v", gitDir, err)
+	}
+
+	// Remove the volume's record and the records of its attachments.
+	if err := s.store.deleteVolume(ctx, req.VolumeId); err != nil {
+		return nil, err
+	}
+	s.attL.Lock()
+	defer s.attL.Unlock()
+	if _, err := s.store.removeAttachments(
+		ctx, "", req.VolumeId); err != nil {
+		return nil, err
+	}
+
 	// Indicate the operation was a success.
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -147,16 +310,22 @@ func (s *service) ControllerPublishVolume(
 	req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	// Get the existing volume info.
-	vol, err := s.getVolume(req.VolumeId)
+	// Get the existing volume info. A volume may not be published until
+	// its contents are copied.
+	vol, err := s.getVolume(ctx, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkNotCloning(vol); err != nil {
+		return nil, err
+	}
 
 	// Verify that the requested capability is compatible with the volume's
-	// capabilities.
+	// capabilities. Mount flags are applied when the volume is published
+	// and are not compared.
 	if ok, err := csiutils.IsVolumeCapabilityCompatible(
-		req.VolumeCapability, vol.VolumeCapabilities); !ok {
+		withoutMountFlags(req.VolumeCapability)[0],
+		withoutMountFlags(vol.VolumeCapabilities...)); !ok {
 		if err != nil {
 			return nil, err
 		}
@@ -164,49 +333,76 @@ func (s *service) ControllerPublishVolume(
 			codes.InvalidArgument, "invalid volume capability")
 	}
 
-	// Get the path of the volume's device and see if it exists.
-	devPath := path.Join(s.dev, req.VolumeId)
-	ok, err := fileExists(devPath)
+	// Get the information recorded by the node.
+	node, err := s.getNode(req.NodeId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "%s: %v", devPath, err)
+		return nil, err
 	}
 
-	// If the volume's device path already exists then check to see if
-	// this is an idempotent publish.
-	if !ok {
-		if err := os.MkdirAll(devPath, 0755); err != nil {
+	// Verify the node's topology satisfies the volume's accessible
+	// topology. Volumes without a topology may be published to any node.
+	if len(vol.accessibleTopology) > 0 {
+		if node == nil {
 			return nil, status.Errorf(
-				codes.Internal, "mkdir failed: %s: %v", devPath, err)
+				codes.NotFound, "unknown node: %s", req.NodeId)
+		}
+		if err := isTopologyCompatible(
+			vol.accessibleTopology, node.Topology); err != nil {
+			return nil, err
 		}
 	}
 
-	// Get the mount info to determine if the volume dir is already
-	// bind mounted to the device dir.
-	minfo, err := getMounts(ctx)
+	// Serialize access to the attachment records so that concurrent
+	// requests for different volumes cannot exceed the node's limit.
+	s.attL.Lock()
+	defer s.attL.Unlock()
+
+	// Get the existing attachment record. If the volume is not already
+	// attached to the node then ensure the node's limit is not exceeded.
+	att, err := s.store.getAttachment(ctx, req.NodeId, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(
-			codes.Internal, "failed to get mount info: %v", err)
+		return nil, err
 	}
-	mounted := false
-	for _, i := range minfo {
-		// If bindfs is not used then the device path will not match
-		// the volume path, otherwise test both the source and target.
-		if i.Source == vol.path && i.Path == devPath {
-			mounted = true
-			break
+	if att == nil {
+		if max := s.getMaxVolumes(node); max > 0 {
+			count, err := s.store.countAttachments(ctx, req.NodeId)
+			if err != nil {
+				return nil, err
+			}
+			if count >= max {
+				return nil, status.Errorf(codes.ResourceExhausted,
+					"max volumes attached to node: %s: %d",
+					req.NodeId, max)
+			}
 		}
 	}
 
-	if !mounted {
-		if err := gofsutil.BindMount(ctx, vol.path, devPath); err != nil {
-			return nil, status.Errorf(
-				codes.Internal, "bind mount failed: src=%s, tgt=%s: %v",
-				vol.path, devPath, err)
+	// Get the path of the volume's device. A process that serves only
+	// the controller service keeps a record of the attachment and
+	// leaves the volume's device mount to the node service.
+	devPath := path.Join(s.dev, req.VolumeId)
+	pubInfo := map[string]string{publishInfoPath: devPath}
+	if s.mode == modeController {
+		pubInfo = map[string]string{publishInfoNodeID: req.NodeId}
+	} else if err := s.mountDevice(ctx, vol.path, devPath); err != nil {
+		return nil, err
+	}
+
+	// Record the attachment.
+	if att == nil {
+		att = &attachmentInfo{
+			VolumeID: req.VolumeId,
+			NodeID:   req.NodeId,
+			Readonly: req.Readonly,
+			DevPath:  pubInfo[publishInfoPath],
+		}
+		if err := s.store.saveAttachment(ctx, att); err != nil {
+			return nil, err
 		}
 	}
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishInfo: map[string]string{"path": devPath},
+		PublishInfo: pubInfo,
 	}, nil
 }
 
@@ -224,38 +420,31 @@ func (s *service) ControllerUnpublishVolume(
 		return nil, status.Error(codes.NotFound, volPath)
 	}
 
-	// Get the path of the volume's device.
-	devPath := path.Join(s.dev, req.VolumeId)
-
-	// Get the node's mount information.
-	minfo, err := getMounts(ctx)
-	if err != nil {
-		return nil, status.Errorf(
-			codes.Internal, "failed to get mount info: %v", err)
-	}
-
-	// The loop below unmounts the device path if it is mounted.
-	for _, i := range minfo {
-		// If there is a device that matches the volPath value and
-		// a path that matches the devPath value then unmount it as
-		// it is the subject of this request.
-		if i.Source == volPath && i.Path == devPath {
-			if err := gofsutil.Unmount(ctx, devPath); err != nil {
-				return nil, status.Errorf(codes.Internal,
-					"failed to unmount device dir: %s: %v", devPath, err)
-			}
+	// Remove the record of the volume's attachment to the node, or
+	// to all nodes if no node is specified. The device is not unmounted
+	// while the volume remains attached to other nodes.
+	if req.NodeId != "" {
+		if err := validateNodeID(req.NodeId); err != nil {
+			return nil, err
 		}
 	}
-
-	// If the device path exists then remove it.
-	ok, err := fileExists(devPath)
+	s.attL.Lock()
+	defer s.attL.Unlock()
+	remaining, err := s.store.removeAttachments(
+		ctx, req.NodeId, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "%s: %v", devPath, err)
+		return nil, err
+	}
+	if remaining > 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
-	if ok {
-		if err := os.RemoveAll(devPath); err != nil {
-			return nil, status.Errorf(codes.Internal,
-				"failed to remove device dir: %s: %v", devPath, err)
+
+	// Unmount and remove the volume's device unless this process
+	// serves only the controller service.
+	if s.mode != modeController {
+		devPath := path.Join(s.dev, req.VolumeId)
+		if err := s.unmountDevice(ctx, volPath, devPath); err != nil {
+			return nil, err
 		}
 	}
 
@@ -268,7 +457,7 @@ func (s *service) ValidateVolumeCapabilities(
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	// Get the existing volume info.
-	vol, err := s.getVolume(req.VolumeId)
+	vol, err := s.getVolume(ctx, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
@@ -287,6 +476,24 @@ func (s *service) ValidateVolumeCapabilities(
 		msg = "incompatible volume capabilities"
 	}
 
+	// Re-apply the volume's ACLs and extended attributes in case
+	// they drifted since the volume was created. A sealed volume's root
+	// directory may be immutable.
+	attrs, err := getVolumeAttrPolicy(vol.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if attrs != nil && vol.sealed.IsZero() {
+		changed, err := attrs.apply(vol.path)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			log.WithField("volume", req.VolumeId).Warn(
+				"repaired volume acl and xattr drift")
+		}
+	}
+
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Supported: supported,
 		Message:   msg,
@@ -298,26 +505,22 @@ func (s *service) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	fileNames, err := filepath.Glob(s.volGlob)
+	vols, err := s.store.listVolumes(ctx)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"failed to list volume dir: %s: %v", s.volGlob, err)
+		return nil, err
 	}
 
 	rep := &csi.ListVolumesResponse{
-		Entries: make([]*csi.ListVolumesResponse_Entry, len(fileNames)),
+		Entries: make([]*csi.ListVolumesResponse_Entry, 0, len(vols)),
 	}
-	for i, volInfoPath := range fileNames {
-		vol := volumeInfo{
-			path:     path.Dir(volInfoPath),
-			infoPath: volInfoPath,
-		}
-		if err := vol.load(); err != nil {
-			return nil, err
+	for _, vol := range vols {
+		// A clone is not listed until CreateVolume completes its copy.
+		if vol.clone != nil {
+			continue
 		}
-		rep.Entries[i] = &csi.ListVolumesResponse_Entry{
+		rep.Entries = append(rep.Entries, &csi.ListVolumesResponse_Entry{
 			Volume: vol.toCSIVolInfo(),
-		}
+		})
 	}
 
 	return rep, nil
@@ -336,6 +539,8 @@ func (s *service) ControllerGetCapabilities(
 	req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
+	// Snapshots are created with the SP's administrative commands and
+	// are not advertised since CSI 0.2.0 has no snapshot RPCs.
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: []*csi.ControllerServiceCapability{
 			&csi.ControllerServiceCapability{
@@ -368,5 +573,11 @@ func (s *service) ControllerProbe(
 	req *csi.ControllerProbeRequest) (
 	*csi.ControllerProbeResponse, error) {
 
+	// Only the leader of the controllers is ready to serve the
+	// controller service.
+	if !s.isLeader() {
+		return nil, status.Error(codes.FailedPrecondition, "not the leader")
+	}
+
 	return &csi.ControllerProbeResponse{}, nil
 }
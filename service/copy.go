@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// copyTree copies the directory tree at src to dst, which is created if
+// it does not exist. Regular files are cloned with reflinks when the
+// filesystem supports them and otherwise copied. Directories, regular
+// files, and symlinks keep their ownership and modes, and directories
+// and regular files keep their extended attributes and modification
+// times. Other types of files are not copied. Files in the root of src
+// with the excluded names are not copied. If progress is not nil then the
+// number of bytes copied is atomically added to it as files are copied.
+// The copy stops with the context's error once the context is cancelled.
+// The total size of the copied regular files is returned.
+func copyTree(
+	ctx context.Context,
+	src, dst string, progress *int64, exclude ...string) (int64, error) {
+
+	var (
+		size int64
+		dirs []string
+	)
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if isExcluded(rel, exclude) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, p)
+		case fi.Mode().IsRegular():
+			if err := copyFile(ctx, p, target, progress); err != nil {
+				return err
+			}
+			size += fi.Size()
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return copyOwner(fi, target)
+		default:
+			return nil
+		}
+		return copyMetadata(p, fi, target)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The modes and modification times of directories are copied after
+	// their contents since a directory's mode may not permit writing its
+	// contents and writing its contents changes its times.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Stat(dirs[i])
+		if err != nil {
+			return 0, err
+		}
+		rel, _ := filepath.Rel(src, dirs[i])
+		target := filepath.Join(dst, rel)
+		if err := os.Chmod(target, fi.Mode()); err != nil {
+			return 0, err
+		}
+		if err := os.Chtimes(target, fi.ModTime(), fi.ModTime()); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// clearDir removes the contents of the directory, except the files in
+// its root with the excluded names.
+func clearDir(dir string, exclude ...string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if isExcluded(name, exclude) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeSize returns the total size of the regular files in the directory
+// tree at dir. Files in the root of dir with the excluded names are not
+// counted.
+func treeSize(dir string, exclude ...string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if isExcluded(rel, exclude) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func isExcluded(rel string, exclude []string) bool {
+	for _, name := range exclude {
+		if rel == name {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the contents of a regular file, cloning the file when
+// the filesystem supports reflinks. If progress is not nil then the
+// number of bytes copied is atomically added to it.
+func copyFile(ctx context.Context, src, dst string, progress *int64) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := cloneFile(w, r); err == nil {
+		if progress != nil {
+			if fi, err := r.Stat(); err == nil {
+				atomic.AddInt64(progress, fi.Size())
+			}
+		}
+		return w.Close()
+	}
+	cw := &progressWriter{ctx: ctx, w: w, n: progress}
+	if _, err := io.Copy(cw, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// progressWriter atomically adds the number of bytes written to a
+// counter, if the counter is not nil. Writes fail once the context is
+// cancelled.
+type progressWriter struct {
+	ctx context.Context
+	w   io.Writer
+	n   *int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	if p.n != nil {
+		atomic.AddInt64(p.n, int64(n))
+	}
+	return n, err
+}
+
+// copyMetadata copies the ownership and extended attributes of a
+// directory or regular file, and the mode and modification time of a
+// regular file.
+func copyMetadata(src string, fi os.FileInfo, dst string) error {
+	if err := copyOwner(fi, dst); err != nil {
+		return err
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	if err := os.Chmod(dst, fi.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// copyOwner copies the ownership of a file. Ownership is not copied if
+// the process is not permitted to change it.
+func copyOwner(fi os.FileInfo, dst string) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if os.IsPermission(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// ficlone is the ioctl that clones a file with a reflink.
+const ficlone = 0x40049409
+
+// cloneFile clones the contents of the source file into the destination
+// file. An error is returned if the filesystem does not support reflinks
+// or the files are on different filesystems.
+func cloneFile(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyXattrs copies the extended attributes of a file. Attributes the
+// process is not permitted to set, or that the destination's filesystem
+// does not support, are not copied.
+func copyXattrs(src, dst string) error {
+	names, err := listxattr(src)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		val, err := getxattr(src, name)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			continue
+		}
+		err = syscall.Setxattr(dst, name, val, 0)
+		switch err {
+		case nil, syscall.EPERM, syscall.ENOTSUP:
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// listxattr returns the names of the extended attributes of a file.
+func listxattr(path string) ([]string, error) {
+	for {
+		sz, err := syscall.Listxattr(path, nil)
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			// The list grew since its size was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
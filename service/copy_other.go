@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// cloneFile returns an error since files are only cloned on Linux.
+func cloneFile(dst, src *os.File) error {
+	return syscall.ENOTSUP
+}
+
+// copyXattrs does nothing since extended attributes are only copied on
+// Linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+const (
+	// dataLayoutVersion is the version of the layout of the data
+	// directory. It is incremented when the layout changes in a way
+	// that older versions of the plug-in cannot read.
+	dataLayoutVersion = 1
+
+	// dataOwnerFileName is the name of the file in the data directory
+	// that is locked by the process that owns the directory and that
+	// records the directory's layout.
+	dataOwnerFileName = ".owner.json"
+
+	// dataLockTimeout is the amount of time a process that shares the
+	// data directory waits for another such process to record the
+	// directory's layout.
+	dataLockTimeout = time.Second
+)
+
+// checkDataShared returns an error if the configuration requires other
+// processes to use the data directory but the directory is not shared.
+// The file leader election and file locks are only useful when several
+// processes use the same data directory.
+func checkDataShared(ctx context.Context, shared bool) error {
+	if shared {
+		return nil
+	}
+	if strings.EqualFold(csictx.Getenv(ctx, EnvVarLeaderElection),
+		leaderElectionFile) {
+		return fmt.Errorf("%s=%s requires %s=true",
+			EnvVarLeaderElection, leaderElectionFile, EnvVarDataShared)
+	}
+	if v, _ := strconv.ParseBool(csictx.Getenv(ctx, EnvVarFileLocks)); v {
+		return fmt.Errorf("%s=true requires %s=true",
+			EnvVarFileLocks, EnvVarDataShared)
+	}
+	return nil
+}
+
+// dataOwnerInfo is the layout marker persisted in the data directory
+// by the process that owns it.
+type dataOwnerInfo struct {
+	Version int       `json:"version"`
+	PID     int       `json:"pid"`
+	Host    string    `json:"host,omitempty"`
+	Started time.Time `json:"started"`
+	Dev     string    `json:"dev"`
+	Mnt     string    `json:"mnt"`
+	Vol     string    `json:"vol"`
+}
+
+func (o *dataOwnerInfo) String() string {
+	return fmt.Sprintf("pid=%d, host=%s, dev=%s, mnt=%s, vol=%s",
+		o.PID, o.Host, o.Dev, o.Mnt, o.Vol)
+}
+
+// lockDataDir takes an exclusive lock on the data directory and records
+// the directory's layout. An error is returned if another live process
+// owns the directory or if the directory's layout is newer than this
+// version of the plug-in supports.
+//
+// If the data directory is shared then a shared lock is taken instead,
+// so processes that share the directory exclude a process that does
+// not. The layout is only recorded if it was not recorded by another
+// process, and only while the lock is exclusive so that no other process
+// reads the record while it is written. The lock is then downgraded to
+// a shared lock.
+func (s *service) lockDataDir(ctx context.Context, shared bool) error {
+
+	ownerPath := path.Join(s.data, dataOwnerFileName)
+	f, err := os.OpenFile(ownerPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fd := int(f.Fd())
+
+	// An exclusive lock is taken first. A process that shares the data
+	// directory takes a shared lock instead if another process holds a
+	// lock.
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	exclusive := err == nil
+	if shared && err == syscall.EWOULDBLOCK {
+		err = lockDataDirShared(fd)
+	}
+	if err != nil {
+		defer f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		owner := &dataOwnerInfo{}
+		json.NewDecoder(f).Decode(owner)
+		if shared {
+			return fmt.Errorf("data dir owned by a process that does "+
+				"not share it: %s: %s: set %s=true for every process "+
+				"that uses the data dir", s.data, owner, EnvVarDataShared)
+		}
+		return fmt.Errorf("data dir in use by another process: "+
+			"%s: %s: set %s=true to share the data dir",
+			s.data, owner, EnvVarDataShared)
+	}
+
+	// Ensure the layout was not recorded by a newer version.
+	prev := &dataOwnerInfo{}
+	if err := json.NewDecoder(f).Decode(prev); err == nil &&
+		prev.Version > dataLayoutVersion {
+		f.Close()
+		return fmt.Errorf("data dir layout version unsupported: %s: %d > %d",
+			s.data, prev.Version, dataLayoutVersion)
+	}
+
+	if shared && (prev.Version > 0 || !exclusive) {
+		if prev.Version > 0 && (prev.Dev != s.dev ||
+			prev.Mnt != s.mnt || prev.Vol != s.vol) {
+			log.WithField("owner", prev.String()).Warn(
+				"shared data dir layout mismatch")
+		}
+		return s.setDataLock(f, shared && exclusive)
+	}
+
+	owner := &dataOwnerInfo{
+		Version: dataLayoutVersion,
+		PID:     os.Getpid(),
+		Started: time.Now().UTC(),
+		Dev:     s.dev,
+		Mnt:     s.mnt,
+		Vol:     s.vol,
+	}
+	owner.Host, _ = os.Hostname()
+	buf, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(append(buf, '\n'), 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	return s.setDataLock(f, shared && exclusive)
+}
+
+// setDataLock keeps the locked owner file of the data directory open so
+// the lock is held until the process exits. The exclusive lock of a
+// process that shares the data directory is downgraded to a shared lock.
+func (s *service) setDataLock(f *os.File, downgrade bool) error {
+	if downgrade {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to share data dir lock: %s: %v",
+				s.data, err)
+		}
+	}
+	s.dataLock = f
+	return nil
+}
+
+// lockDataDirShared takes a shared lock on the owner file of the data
+// directory. It waits briefly for another process that shares the
+// directory to downgrade the exclusive lock it holds while it records
+// the directory's layout.
+func lockDataDirShared(fd int) error {
+	deadline := time.Now().Add(dataLockTimeout)
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_SH|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(fileLockRetryInterval)
+	}
+}
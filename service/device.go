@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/akutz/gofsutil"
+)
+
+// mountDevice bind mounts the volume's directory to the volume's
+// device directory if it is not already mounted.
+func (s *service) mountDevice(ctx context.Context, volPath, devPath string) error {
+
+	// Get the path of the volume's device and see if it exists.
+	ok, err := fileExists(devPath)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "%s: %v", devPath, err)
+	}
+
+	// If the volume's device path already exists then check to see if
+	// this is an idempotent publish.
+	if !ok {
+		if err := os.MkdirAll(devPath, 0755); err != nil {
+			return status.Errorf(
+				codes.Internal, "mkdir failed: %s: %v", devPath, err)
+		}
+	}
+
+	// Get the mount info to determine if the volume dir is already
+	// bind mounted to the device dir.
+	minfo, err := getMounts(ctx)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal, "failed to get mount info: %v", err)
+	}
+	for _, i := range minfo {
+		// If bindfs is not used then the device path will not match
+		// the volume path, otherwise test both the source and target.
+		if i.Source == volPath && i.Path == devPath {
+			return nil
+		}
+	}
+
+	if err := gofsutil.BindMount(ctx, volPath, devPath); err != nil {
+		return status.Errorf(
+			codes.Internal, "bind mount failed: src=%s, tgt=%s: %v",
+			volPath, devPath, err)
+	}
+	return nil
+}
+
+// unmountDevice unmounts the volume's device directory if it is mounted
+// and then removes it.
+func (s *service) unmountDevice(
+	ctx context.Context, volPath, devPath string) error {
+
+	// Get the node's mount information.
+	minfo, err := getMounts(ctx)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal, "failed to get mount info: %v", err)
+	}
+
+	// The loop below unmounts the device path if it is mounted.
+	for _, i := range minfo {
+		// If there is a device that matches the volPath value and
+		// a path that matches the devPath value then unmount it as
+		// it is the subject of this request.
+		if i.Source == volPath && i.Path == devPath {
+			if err := gofsutil.Unmount(ctx, devPath); err != nil {
+				return status.Errorf(codes.Internal,
+					"failed to unmount device dir: %s: %v", devPath, err)
+			}
+		}
+	}
+
+	// If the device path exists then remove it.
+	ok, err := fileExists(devPath)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "%s: %v", devPath, err)
+	}
+	if ok {
+		if err := os.RemoveAll(devPath); err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to remove device dir: %s: %v", devPath, err)
+		}
+	}
+
+	return nil
+}
@@ -35,6 +35,13 @@ const (
 	// If not specified, the directory defaults to `$X_CSI_VFS_DATA/vol`.
 	EnvVarVolDir = "X_CSI_VFS_VOL"
 
+	// EnvVarSnapDir is the name of the environment variable
+	// used to obtain the path to the VFS plug-in's `snap` directory,
+	// which contains the contents of snapshots.
+	//
+	// If not specified, the directory defaults to `$X_CSI_VFS_DATA/snap`.
+	EnvVarSnapDir = "X_CSI_VFS_SNAP"
+
 	// EnvVarVolGlob is the name of the environment variable
 	// used to obtain the glob pattern used to list the files inside
 	// the $X_CSI_VFS_VOL directory. Matching files are considered
@@ -45,4 +52,172 @@ const (
 	// Valid patterns are documented at
 	// https://golang.org/pkg/path/filepath/#Match.
 	EnvVarVolGlob = "X_CSI_VFS_VOL_GLOB"
+
+	// EnvVarNodesDir is the name of the environment variable
+	// used to obtain the path to the VFS plug-in's `nodes` directory.
+	// Each node service records its ID and topology in this directory
+	// so the controller service may validate ControllerPublishVolume
+	// requests against a node's topology.
+	//
+	// If not specified, the directory defaults to `$X_CSI_VFS_DATA/nodes`.
+	EnvVarNodesDir = "X_CSI_VFS_NODES"
+
+	// EnvVarNodeID is the name of the environment variable
+	// used to obtain the ID returned by NodeGetId.
+	//
+	// If not specified, the node ID defaults to the host's name.
+	EnvVarNodeID = "X_CSI_VFS_NODE_ID"
+
+	// EnvVarNodeTopology is the name of the environment variable
+	// used to obtain the node's topology labels. The value is a
+	// comma-delimited list of key=value pairs, ex. `zone=a,rack=1`.
+	//
+	// A volume created with one or more `topology.<key>` parameters
+	// may only be published to nodes whose labels match all of the
+	// volume's topology keys.
+	EnvVarNodeTopology = "X_CSI_VFS_NODE_TOPOLOGY"
+
+	// EnvVarNodeMaxVolumes is the name of the environment variable
+	// used to obtain the maximum number of volumes that may be attached
+	// to the node. The limit is recorded along with the node's ID and
+	// topology in the nodes directory where the controller service
+	// and other tools may read it.
+	//
+	// If not specified, or zero, the controller's default limit is used.
+	EnvVarNodeMaxVolumes = "X_CSI_VFS_NODE_MAX_VOLUMES"
+
+	// EnvVarMaxVolumesPerNode is the name of the environment variable
+	// used to obtain the controller's default maximum number of volumes
+	// that may be attached to a node that has not recorded its own limit.
+	//
+	// If not specified, or zero, the number of attached volumes is
+	// not limited.
+	EnvVarMaxVolumesPerNode = "X_CSI_VFS_MAX_VOLUMES_PER_NODE"
+
+	// EnvVarStore is the name of the environment variable used to
+	// specify the store that persists the metadata of volumes and their
+	// attachments. Valid values are `file` and `etcd`.
+	//
+	// The `file` store persists a volume's metadata in the volume's
+	// `.info.json` file and attachments in `$X_CSI_VFS_DATA/att`.
+	//
+	// The `etcd` store persists the metadata in etcd so that multiple
+	// controllers may share the same logical store.
+	//
+	// If not specified, the store defaults to `file`.
+	EnvVarStore = "X_CSI_VFS_STORE"
+
+	// EnvVarEtcdEndpoints is the name of the environment variable
+	// used to obtain the comma-delimited list of endpoints used by
+	// the `etcd` store.
+	//
+	// If not specified, the endpoints default to the value of
+	// `X_CSI_SERIAL_VOL_ACCESS_ETCD_ENDPOINTS`.
+	EnvVarEtcdEndpoints = "X_CSI_VFS_ETCD_ENDPOINTS"
+
+	// EnvVarEtcdPrefix is the name of the environment variable
+	// used to obtain the prefix of the keys used by the `etcd` store.
+	//
+	// If not specified, the prefix defaults to `/csi-vfs`.
+	EnvVarEtcdPrefix = "X_CSI_VFS_ETCD_PREFIX"
+
+	// EnvVarEtcdDialTimeout is the name of the environment variable
+	// used to obtain the timeout for establishing a connection to etcd.
+	EnvVarEtcdDialTimeout = "X_CSI_VFS_ETCD_DIAL_TIMEOUT"
+
+	// EnvVarEtcdRequestTimeout is the name of the environment variable
+	// used to obtain the timeout of each request the `etcd` store makes
+	// to etcd.
+	//
+	// If not specified, the timeout defaults to `10s`.
+	EnvVarEtcdRequestTimeout = "X_CSI_VFS_ETCD_REQUEST_TIMEOUT"
+
+	// EnvVarLeaderElection is the name of the environment variable
+	// used to specify how the leader of several controllers is elected.
+	// Only the leader serves CreateVolume, DeleteVolume,
+	// ControllerPublishVolume, and ControllerUnpublishVolume. The other
+	// controllers return Unavailable for these RPCs. Valid values are
+	// `file` and `etcd`.
+	//
+	// The `file` election elects the controller that holds an exclusive
+	// lock on `$X_CSI_VFS_DATA/leader.lock`. The data directory must be
+	// shared by the controllers.
+	//
+	// The `etcd` election uses the etcd client configured with the
+	// X_CSI_VFS_ETCD_* environment variables.
+	//
+	// If not specified, leader election is disabled.
+	EnvVarLeaderElection = "X_CSI_VFS_LEADER_ELECTION"
+
+	// EnvVarLeaderElectionTTL is the name of the environment variable
+	// used to obtain the TTL of the session of an `etcd` leader. The
+	// leader loses its leadership if it fails to renew the session
+	// before the TTL expires.
+	//
+	// If not specified, the TTL defaults to 60s.
+	EnvVarLeaderElectionTTL = "X_CSI_VFS_LEADER_ELECTION_TTL"
+
+	// EnvVarFileLocks is the name of the environment variable used
+	// to specify whether or not serial volume access is enforced across
+	// processes with file locks in `$X_CSI_VFS_DATA/locks`. Processes on
+	// the same host that share the data directory do not serve requests
+	// for the same volume at the same time.
+	//
+	// File locks are only used if `X_CSI_SERIAL_VOL_ACCESS` is true.
+	//
+	// If not specified, the value defaults to false.
+	EnvVarFileLocks = "X_CSI_VFS_FILE_LOCKS"
+
+	// EnvVarDataShared is the name of the environment variable used
+	// to specify whether or not the data directory is deliberately shared
+	// by several processes, for example controllers that use the `file`
+	// leader election or processes that use file locks.
+	//
+	// A process that does not share the data directory takes an exclusive
+	// lock on it, and a process that shares it takes a shared lock. A
+	// process refuses to start if it cannot take its lock. The `file`
+	// leader election and file locks require this to be true.
+	//
+	// If not specified, the value defaults to false.
+	EnvVarDataShared = "X_CSI_VFS_DATA_SHARED"
+
+	// EnvVarMountFlags is the name of the environment variable used
+	// to obtain the comma-separated list of MountVolume mount flags that
+	// NodePublishVolume applies to a target's bind mount. Requests with
+	// any other flag fail with InvalidArgument. Only flags that apply to
+	// a bind mount are valid: ro, rw, nosuid, suid, nodev, dev, noexec,
+	// exec, noatime, atime, nodiratime, diratime, relatime, norelatime,
+	// strictatime, and nosymfollow.
+	//
+	// If not specified, all of the valid flags except rw and nosymfollow
+	// are allowed.
+	EnvVarMountFlags = "X_CSI_VFS_MOUNT_FLAGS"
+
+	// EnvVarMountFlagsDeny is the name of the environment variable used
+	// to obtain the comma-separated list of mount flags that are removed
+	// from the allowed mount flags.
+	EnvVarMountFlagsDeny = "X_CSI_VFS_MOUNT_FLAGS_DENY"
+
+	// EnvVarZstd is the name of the environment variable used to
+	// obtain the path to the `zstd` binary, which decompresses the
+	// zstd-compressed archives that seed new volumes.
+	//
+	// If not specified, `zstd` is looked up via the path.
+	EnvVarZstd = "X_CSI_VFS_ZSTD"
+
+	// EnvVarGit is the name of the environment variable used to obtain
+	// the path to the `git` binary, which clones the git repositories
+	// that populate new volumes.
+	//
+	// If not specified, `git` is looked up via the path.
+	EnvVarGit = "X_CSI_VFS_GIT"
+
+	// EnvVarContentRoot is the name of the environment variable used
+	// to obtain the path of the directory that contains the archives,
+	// OCI image layouts, and git repositories that populate new
+	// volumes. A source whose path, with its symlinks resolved, is
+	// outside of the directory is refused.
+	//
+	// If not specified, volumes may not be populated from local paths.
+	EnvVarContentRoot = "X_CSI_VFS_CONTENT_ROOT"
 )
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ExpandVolume raises the capacity of the volume to the required bytes
+// and returns the volume's capacity. A volume whose capacity is at least
+// the required bytes is not changed. A volume may be expanded while it
+// is published.
+//
+// The capacity of a volume's directory is not enforced, so only the
+// volume's record is updated, except for a projected volume, whose tmpfs
+// targets are limited to its capacity. The targets of a projected volume
+// are remounted with the new capacity, which is only possible on the
+// host that runs this process, so a projected volume that is attached to
+// another node may not be expanded.
+func (s *service) ExpandVolume(
+	ctx context.Context, id string, requiredBytes int64) (int64, error) {
+
+	unlock, err := s.lockVolume(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	vol, err := s.getVolume(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkNotCloning(vol); err != nil {
+		return 0, err
+	}
+	if vol.capacityBytes >= requiredBytes {
+		return vol.capacityBytes, nil
+	}
+	if !vol.sealed.IsZero() {
+		return 0, status.Errorf(codes.FailedPrecondition,
+			"volume is sealed: %s", id)
+	}
+
+	fields := map[string]interface{}{
+		"volume": id,
+		"from":   vol.capacityBytes,
+		"to":     requiredBytes,
+	}
+
+	// Resize the tmpfs targets of a projected volume before the new
+	// capacity is recorded, and restore their size if it is not.
+	var resized []string
+	if projected, _ := isProjected(vol.Parameters); projected {
+		atts, err := s.store.listAttachments(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		for _, att := range atts {
+			if att.NodeID != s.nodeID {
+				return 0, status.Errorf(codes.FailedPrecondition,
+					"projected volume is attached to another node: "+
+						"%s: node=%s: its targets cannot be resized",
+					id, att.NodeID)
+			}
+		}
+		if resized, err = s.resizeProjected(
+			ctx, id, vol.capacityBytes, requiredBytes); err != nil {
+			return 0, err
+		}
+		fields["targets"] = len(resized)
+	}
+
+	oldBytes := vol.capacityBytes
+	vol.capacityBytes = requiredBytes
+	if err := s.store.saveVolume(ctx, vol); err != nil {
+		for _, tgtPath := range resized {
+			remountProjected(ctx, tgtPath, oldBytes)
+		}
+		return 0, err
+	}
+	log.WithFields(fields).Info("expanded volume")
+	return vol.capacityBytes, nil
+}
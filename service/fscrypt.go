@@ -0,0 +1,127 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramEncrypted is the CreateVolume parameter that indicates the
+	// volume's directory is encrypted with a kernel fscrypt policy.
+	paramEncrypted = "encrypted"
+
+	// credEncryptionKey is the CreateVolume and NodePublishVolume
+	// credential that contains the hex-encoded key of an encrypted
+	// volume. The key is added to the filesystem by NodePublishVolume,
+	// and CreateVolume only derives the identifier of the key in the
+	// volume's encryption policy from it, so both requests must be
+	// given the same key.
+	credEncryptionKey = "encryptionKey"
+
+	// fscryptKeySize is the size of an encryption key. A volume's files
+	// are encrypted with AES-256-XTS, which requires a 64 byte key.
+	fscryptKeySize = 64
+)
+
+// fscryptKeyID is the identifier of an fscrypt master key.
+type fscryptKeyID [16]byte
+
+func (id fscryptKeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// isEncrypted returns a flag that indicates whether the CreateVolume
+// parameters request an encrypted volume.
+func isEncrypted(params map[string]string) (bool, error) {
+	v, ok := params[paramEncrypted]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"invalid param: %s=%s", paramEncrypted, v)
+	}
+	return b, nil
+}
+
+// getEncryptionKey returns the encryption key from the credentials.
+func getEncryptionKey(creds map[string]string) ([]byte, error) {
+	v, ok := creds[credEncryptionKey]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"encrypted volume requires credential: %s", credEncryptionKey)
+	}
+	key, err := hex.DecodeString(v)
+	if err != nil || len(key) != fscryptKeySize {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid credential: %s: must be a hex-encoded %d byte key",
+			credEncryptionKey, fscryptKeySize)
+	}
+	return key, nil
+}
+
+// getKeyID returns the identifier the kernel derives from a master key
+// with HKDF-SHA512, so the policy of a new volume may be set without
+// adding the key to the filesystem.
+func getKeyID(key []byte) fscryptKeyID {
+	// HKDF-Extract with the default salt of zeros.
+	mac := hmac.New(sha512.New, make([]byte, sha512.Size))
+	mac.Write(key)
+	prk := mac.Sum(nil)
+
+	// HKDF-Expand with the fscrypt prefix and the key identifier
+	// context. A single block is enough for the identifier.
+	mac = hmac.New(sha512.New, prk)
+	mac.Write([]byte("fscrypt\x00\x01\x01"))
+	var id fscryptKeyID
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+// addVolumeKey adds the key of an encrypted volume to the keyring of the
+// volume's filesystem after verifying it is the key of the volume's
+// encryption policy. The key's identifier is returned.
+func addVolumeKey(dir string, key []byte) (fscryptKeyID, error) {
+	id := getKeyID(key)
+	policyID, ok, err := getEncryptionPolicyKeyID(dir)
+	if err != nil {
+		return id, err
+	}
+	if !ok {
+		return id, status.Errorf(codes.FailedPrecondition,
+			"volume is not encrypted: %s", dir)
+	}
+	if id != policyID {
+		return id, status.Errorf(codes.PermissionDenied,
+			"invalid encryption key: %s", dir)
+	}
+	return id, addEncryptionKey(dir, key)
+}
+
+// removeVolumeKey removes the key with the hex-encoded identifier from
+// the keyring of the volume's filesystem.
+func removeVolumeKey(dir, keyID string) error {
+	var id fscryptKeyID
+	b, err := hex.DecodeString(keyID)
+	if err != nil || len(b) != len(id) {
+		return status.Errorf(codes.Internal,
+			"invalid encryption key id: %s", keyID)
+	}
+	copy(id[:], b)
+	busy, err := removeEncryptionKey(dir, id)
+	if err != nil {
+		return err
+	}
+	if busy {
+		log.WithField("path", dir).Warn(
+			"removed encryption key but files in use remain unlocked")
+	}
+	return nil
+}
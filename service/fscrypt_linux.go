@@ -0,0 +1,159 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The fscrypt ioctls and the values of a version 2 policy.
+const (
+	fsIocSetEncryptionPolicy   = 0x800c6613
+	fsIocGetEncryptionPolicyEx = 0xc0096616
+	fsIocAddEncryptionKey      = 0xc0506617
+	fsIocRemoveEncryptionKey   = 0xc0406618
+
+	fscryptPolicyV2       = 2
+	fscryptModeAES256XTS  = 1
+	fscryptModeAES256CTS  = 4
+	fscryptPolicyFlagsPad = 0x03
+	fscryptKeySpecTypeID  = 2
+	fscryptKeyFilesBusy   = 0x01
+)
+
+type fscryptPolicy struct {
+	version       uint8
+	contentsMode  uint8
+	filenamesMode uint8
+	flags         uint8
+	reserved      [4]uint8
+	keyID         fscryptKeyID
+}
+
+type fscryptGetPolicyArg struct {
+	size   uint64
+	policy fscryptPolicy
+}
+
+type fscryptKeySpec struct {
+	kind     uint32
+	reserved uint32
+	id       [32]byte
+}
+
+type fscryptAddKeyArg struct {
+	spec     fscryptKeySpec
+	rawSize  uint32
+	keyID    uint32
+	reserved [8]uint32
+	raw      [fscryptKeySize]byte
+}
+
+type fscryptRemoveKeyArg struct {
+	spec        fscryptKeySpec
+	statusFlags uint32
+	reserved    [5]uint32
+}
+
+// setEncryptionPolicy sets the encryption policy of an empty directory.
+// Setting the same policy again succeeds.
+func setEncryptionPolicy(dir string, id fscryptKeyID) error {
+	p := fscryptPolicy{
+		version:       fscryptPolicyV2,
+		contentsMode:  fscryptModeAES256XTS,
+		filenamesMode: fscryptModeAES256CTS,
+		flags:         fscryptPolicyFlagsPad,
+		keyID:         id,
+	}
+	if err := fscryptIoctl(
+		dir, fsIocSetEncryptionPolicy, unsafe.Pointer(&p)); err != nil {
+		return fscryptError("failed to set encryption policy", dir, err)
+	}
+	return nil
+}
+
+// getEncryptionPolicyKeyID returns the identifier of the key of the
+// directory's encryption policy. A false value is returned if the
+// directory is not encrypted.
+func getEncryptionPolicyKeyID(dir string) (fscryptKeyID, bool, error) {
+	arg := fscryptGetPolicyArg{size: uint64(unsafe.Sizeof(fscryptPolicy{}))}
+	err := fscryptIoctl(
+		dir, fsIocGetEncryptionPolicyEx, unsafe.Pointer(&arg))
+	if err == syscall.ENODATA {
+		return fscryptKeyID{}, false, nil
+	}
+	if err != nil {
+		return fscryptKeyID{}, false, fscryptError(
+			"failed to get encryption policy", dir, err)
+	}
+	if arg.policy.version != fscryptPolicyV2 {
+		return fscryptKeyID{}, false, status.Errorf(codes.FailedPrecondition,
+			"unsupported encryption policy version: %s: %d",
+			dir, arg.policy.version)
+	}
+	return arg.policy.keyID, true, nil
+}
+
+// addEncryptionKey adds the key to the keyring of the directory's
+// filesystem. Adding a key that was already added succeeds.
+func addEncryptionKey(dir string, key []byte) error {
+	arg := fscryptAddKeyArg{
+		spec:    fscryptKeySpec{kind: fscryptKeySpecTypeID},
+		rawSize: uint32(len(key)),
+	}
+	copy(arg.raw[:], key)
+	defer func() { arg.raw = [fscryptKeySize]byte{} }()
+	if err := fscryptIoctl(
+		dir, fsIocAddEncryptionKey, unsafe.Pointer(&arg)); err != nil {
+		return fscryptError("failed to add encryption key", dir, err)
+	}
+	return nil
+}
+
+// removeEncryptionKey removes the key from the keyring of the
+// directory's filesystem. A true value is returned if the key was
+// removed but files that are still in use remain unlocked.
+func removeEncryptionKey(dir string, id fscryptKeyID) (bool, error) {
+	arg := fscryptRemoveKeyArg{
+		spec: fscryptKeySpec{kind: fscryptKeySpecTypeID},
+	}
+	copy(arg.spec.id[:], id[:])
+	err := fscryptIoctl(dir, fsIocRemoveEncryptionKey, unsafe.Pointer(&arg))
+	if err == syscall.ENOKEY {
+		return false, nil
+	}
+	if err != nil {
+		return false, fscryptError("failed to remove encryption key", dir, err)
+	}
+	return arg.statusFlags&fscryptKeyFilesBusy != 0, nil
+}
+
+func fscryptIoctl(dir string, req uintptr, arg unsafe.Pointer) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fscryptError returns a FailedPrecondition error if the filesystem does
+// not support encryption, otherwise an Internal error.
+func fscryptError(msg, dir string, err error) error {
+	switch err {
+	case syscall.EOPNOTSUPP, syscall.ENOTTY:
+		return status.Errorf(codes.FailedPrecondition,
+			"%s: %s: filesystem does not support encryption", msg, dir)
+	}
+	return status.Errorf(codes.Internal, "%s: %s: %v", msg, dir, err)
+}
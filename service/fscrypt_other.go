@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"runtime"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setEncryptionPolicy returns a FailedPrecondition error since
+// encrypted volumes are only supported on Linux.
+func setEncryptionPolicy(dir string, id fscryptKeyID) error {
+	return errEncryptionUnsupported()
+}
+
+// getEncryptionPolicyKeyID returns a FailedPrecondition error since
+// encrypted volumes are only supported on Linux.
+func getEncryptionPolicyKeyID(dir string) (fscryptKeyID, bool, error) {
+	return fscryptKeyID{}, false, errEncryptionUnsupported()
+}
+
+// addEncryptionKey returns a FailedPrecondition error since encrypted
+// volumes are only supported on Linux.
+func addEncryptionKey(dir string, key []byte) error {
+	return errEncryptionUnsupported()
+}
+
+// removeEncryptionKey returns a FailedPrecondition error since
+// encrypted volumes are only supported on Linux.
+func removeEncryptionKey(dir string, id fscryptKeyID) (bool, error) {
+	return false, errEncryptionUnsupported()
+}
+
+func errEncryptionUnsupported() error {
+	return status.Errorf(codes.FailedPrecondition,
+		"encrypted volumes unsupported: %s", runtime.GOOS)
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramGitRepo is the CreateVolume parameter that specifies the
+	// local git repository that is cloned to a new volume, as an
+	// absolute path or a file:// URL.
+	paramGitRepo = "gitRepo"
+
+	// paramGitRef is the CreateVolume parameter that specifies the
+	// branch, tag, or commit of the git repository that is checked out.
+	paramGitRef = "gitRef"
+
+	// attribGitCommit is the volume attribute that contains the commit
+	// checked out to a volume cloned from a git repository.
+	attribGitCommit = "gitCommit"
+)
+
+// getGitDir returns the path of the git directory of a volume cloned
+// from a git repository. The git directory is kept outside of the
+// volume so that a workload that writes the volume cannot change the
+// configuration or hooks used when the volume is refreshed.
+func (s *service) getGitDir(volumeID string) string {
+	return path.Join(s.data, "git", volumeID)
+}
+
+// getRepoPath returns the path of the local git repository specified by
+// an absolute path or a file:// URL, with its symlinks resolved. The
+// repository must be inside of the content root.
+func (s *service) getRepoPath(repo string) (string, error) {
+	p := repo
+	if strings.HasPrefix(repo, "file://") {
+		u, err := url.Parse(repo)
+		if err != nil || (u.Host != "" && u.Host != "localhost") {
+			return "", status.Errorf(codes.InvalidArgument,
+				"invalid param: %s: invalid file URL: %s", paramGitRepo, repo)
+		}
+		p = u.Path
+	}
+	if !path.IsAbs(p) {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid param: %s: must be an absolute path or file URL: %s",
+			paramGitRepo, repo)
+	}
+	return s.getContentPath(paramGitRepo, "git repository", p)
+}
+
+// cloneRepo clones the git repository in the volume's parameters to the
+// directory of a new volume, checks out the ref in the parameters, and
+// records the commit that is checked out. The volume's default branch is
+// checked out if there is no ref. A branch is checked out as a local
+// branch that tracks the repository's branch, so the volume may be
+// refreshed, and a tag or commit is checked out detached. Cloning a
+// repository again replaces the clone of an earlier attempt.
+func (s *service) cloneRepo(ctx context.Context, vol *volumeInfo) error {
+	repo := vol.Parameters[paramGitRepo]
+	ref := vol.Parameters[paramGitRef]
+	src, err := s.getRepoPath(repo)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(ref, "-") {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid param: %s=%s", paramGitRef, ref)
+	}
+	if _, err := exec.LookPath(s.gitPath); err != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"git repositories require %s: %v", s.gitPath, err)
+	}
+
+	gitDir := s.getGitDir(vol.Name)
+	if err := os.RemoveAll(gitDir); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to remove git dir: %s: %v", gitDir, err)
+	}
+	if err := clearDir(vol.path, infoFileName); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to clear volume: %s: %v", vol.path, err)
+	}
+	if err := os.MkdirAll(path.Dir(gitDir), 0755); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to create git dir: %s: %v", gitDir, err)
+	}
+
+	// Objects are copied instead of hard linked so that a change to the
+	// ownership of the volume's files does not change the repository.
+	if _, err := s.git(ctx, "", "", "clone", "--quiet", "--no-checkout",
+		"--no-hardlinks", "--separate-git-dir", gitDir,
+		"--", src, vol.path); err != nil {
+		return status.Errorf(codes.InvalidArgument,
+			"failed to clone git repository: %s: %v", repo, err)
+	}
+	if err := os.Remove(path.Join(vol.path, ".git")); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to remove git file: %s: %v", vol.path, err)
+	}
+
+	checkout := []string{"checkout", "--quiet", "--force"}
+	target := "HEAD"
+	if ref != "" {
+		if _, err := s.git(ctx, gitDir, vol.path, "rev-parse", "--verify",
+			"--quiet", "refs/remotes/origin/"+ref); err == nil {
+			target = "origin/" + ref
+			checkout = append(checkout, "-B", ref, "--track", target)
+		} else if commit, err := s.git(ctx, gitDir, vol.path, "rev-parse",
+			"--verify", "--quiet", ref+"^{commit}"); err == nil {
+			target = commit
+			checkout = append(checkout, "--detach", target)
+		} else {
+			return status.Errorf(codes.NotFound,
+				"git ref: %s: %s", repo, ref)
+		}
+	}
+	if err := s.checkRepoTree(ctx, vol, target); err != nil {
+		return err
+	}
+	if _, err := s.git(ctx, gitDir, vol.path, checkout...); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to check out git ref: %s: %s: %v", repo, ref, err)
+	}
+
+	size, err := treeSize(vol.path, infoFileName)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to get size of volume: %s: %v", vol.path, err)
+	}
+	if vol.capacityBytes > 0 && size > vol.capacityBytes {
+		return status.Errorf(codes.OutOfRange,
+			"git checkout size exceeds volume capacity: %d", size)
+	}
+
+	commit, err := s.git(ctx, gitDir, vol.path, "rev-parse", "HEAD")
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to get git commit: %s: %v", vol.path, err)
+	}
+	vol.gitCommit = commit
+	log.WithFields(map[string]interface{}{
+		"volume": vol.Name,
+		"repo":   repo,
+		"ref":    ref,
+		"commit": commit,
+	}).Info("cloned git repository")
+	return nil
+}
+
+// RefreshVolume fast-forwards the checkout of a volume cloned from a
+// branch of a git repository to the branch's latest commit, and returns
+// the commit that is checked out. The refresh fails if the branch cannot
+// be fast-forwarded, or if the volume's changes to the checkout conflict
+// with the branch's changes.
+func (s *service) RefreshVolume(
+	ctx context.Context, volumeID string) (string, error) {
+
+	unlock, err := s.lockVolume(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	vol, err := s.getVolume(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := vol.Parameters[paramGitRepo]; !ok {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"volume is not a git clone: %s", volumeID)
+	}
+	if !vol.sealed.IsZero() {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"volume is sealed: %s", volumeID)
+	}
+
+	gitDir := s.getGitDir(volumeID)
+	if _, err := s.git(ctx, gitDir, vol.path,
+		"symbolic-ref", "--quiet", "HEAD"); err != nil {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"volume is not a checkout of a git branch: %s", volumeID)
+	}
+
+	// The repository is resolved again since its path, or the content
+	// root, may have changed since the volume was cloned.
+	src, err := s.getRepoPath(vol.Parameters[paramGitRepo])
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.git(ctx, gitDir, vol.path,
+		"remote", "set-url", "origin", src); err != nil {
+		return "", status.Errorf(codes.Internal,
+			"failed to set git remote: %s: %v", volumeID, err)
+	}
+	if _, err := s.git(ctx, gitDir, vol.path,
+		"fetch", "--quiet", "origin"); err != nil {
+		return "", status.Errorf(codes.Unavailable,
+			"failed to fetch git repository: %s: %v",
+			vol.Parameters[paramGitRepo], err)
+	}
+	if err := s.checkRepoTree(ctx, vol, "@{upstream}"); err != nil {
+		return "", err
+	}
+	if _, err := s.git(ctx, gitDir, vol.path,
+		"merge", "--quiet", "--ff-only", "@{upstream}"); err != nil {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"failed to fast-forward volume: %s: %v", volumeID, err)
+	}
+
+	commit, err := s.git(ctx, gitDir, vol.path, "rev-parse", "HEAD")
+	if err != nil {
+		return "", status.Errorf(codes.Internal,
+			"failed to get git commit: %s: %v", vol.path, err)
+	}
+	if commit == vol.gitCommit {
+		return commit, nil
+	}
+	fields := map[string]interface{}{
+		"volume": volumeID,
+		"from":   vol.gitCommit,
+		"to":     commit,
+	}
+	vol.gitCommit = commit
+	if err := s.store.saveVolume(ctx, vol); err != nil {
+		return "", err
+	}
+	log.WithFields(fields).Info("refreshed volume")
+	return commit, nil
+}
+
+// checkRepoTree returns an error if the tree of the commit has a file
+// that would replace the volume's info file.
+func (s *service) checkRepoTree(
+	ctx context.Context, vol *volumeInfo, commit string) error {
+
+	out, err := s.git(ctx, s.getGitDir(vol.Name), vol.path,
+		"ls-tree", "--name-only", commit, "--", infoFileName)
+	if err != nil {
+		// An empty repository has no HEAD commit to check.
+		return nil
+	}
+	if out != "" {
+		return status.Errorf(codes.InvalidArgument,
+			"git repository has reserved file: %s: %s",
+			vol.Parameters[paramGitRepo], infoFileName)
+	}
+	return nil
+}
+
+// git runs git with the specified git directory and work tree, if they
+// are not empty, and returns its trimmed output. The ownership of the
+// directories is trusted since the volume's owner may differ from the
+// SP's user.
+func (s *service) git(
+	ctx context.Context,
+	gitDir, workTree string,
+	args ...string) (string, error) {
+
+	gitArgs := []string{"-c", "safe.directory=*"}
+	if gitDir != "" {
+		gitArgs = append(gitArgs, "--git-dir", gitDir, "--work-tree", workTree)
+	}
+	cmd := exec.CommandContext(ctx, s.gitPath, append(gitArgs, args...)...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// attribUIDMap is the volume attribute that specifies the user ID
+	// mapping of an ID-mapped target mount.
+	attribUIDMap = "uidMap"
+
+	// attribGIDMap is the volume attribute that specifies the group ID
+	// mapping of an ID-mapped target mount.
+	attribGIDMap = "gidMap"
+)
+
+// idRange maps a range of IDs of files to the IDs seen through an
+// ID-mapped mount.
+type idRange struct {
+	fileID  uint32
+	mountID uint32
+	count   uint32
+}
+
+// identityIDMap maps every ID to itself. It is used for the user or
+// group IDs of an ID-mapped mount when only the other mapping is given.
+var identityIDMap = []idRange{{0, 0, 1<<32 - 1}}
+
+// idMapping is the user and group ID mapping of an ID-mapped mount.
+type idMapping struct {
+	uids []idRange
+	gids []idRange
+}
+
+// getIDMapping returns the ID mapping from the volume attributes. A nil
+// value is returned if neither mapping is specified.
+//
+// Each mapping is a comma or space separated list of ranges in the format
+// "fileID:mountID:count". A file owned by an ID in the range starting at
+// fileID appears through the mount as owned by the ID at the same offset
+// in the range starting at mountID.
+func getIDMapping(attribs map[string]string) (*idMapping, error) {
+	m := &idMapping{}
+	var err error
+	if m.uids, err = parseIDMap(attribUIDMap, attribs[attribUIDMap]); err != nil {
+		return nil, err
+	}
+	if m.gids, err = parseIDMap(attribGIDMap, attribs[attribGIDMap]); err != nil {
+		return nil, err
+	}
+	if m.uids == nil && m.gids == nil {
+		return nil, nil
+	}
+	if m.uids == nil {
+		m.uids = identityIDMap
+	}
+	if m.gids == nil {
+		m.gids = identityIDMap
+	}
+	return m, nil
+}
+
+// parseIDMap parses a comma or space separated list of
+// "fileID:mountID:count" ranges. A nil value is returned if the list
+// is empty.
+func parseIDMap(key, val string) ([]idRange, error) {
+	var a []idRange
+	for _, r := range strings.FieldsFunc(val, func(c rune) bool {
+		return c == ',' || c == ' '
+	}) {
+		f := strings.Split(r, ":")
+		if len(f) != 3 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid attribute: %s=%s", key, val)
+		}
+		var ids [3]uint32
+		for i := range f {
+			id, err := strconv.ParseUint(f[i], 10, 32)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"invalid attribute: %s=%s", key, val)
+			}
+			ids[i] = uint32(id)
+		}
+		if ids[2] == 0 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid attribute: %s=%s: zero count", key, val)
+		}
+		a = append(a, idRange{ids[0], ids[1], ids[2]})
+	}
+	return a, nil
+}
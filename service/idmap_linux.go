@@ -0,0 +1,220 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The flags of the system calls used to create ID-mapped mounts.
+const (
+	atEmptyPath          = 0x1000
+	openTreeClone        = 0x1
+	openTreeCloexec      = syscall.O_CLOEXEC
+	moveMountFEmptyPath  = 0x4
+	mountAttrIDMap       = 0x100000
+	mountAttrSizeVersion = 32
+)
+
+// userNSHolderEnv is the environment variable that instructs the plug-in's
+// binary to hold a user namespace for its parent process instead of
+// running the plug-in.
+const userNSHolderEnv = "X_CSI_VFS_USERNS_HOLDER"
+
+// canHoldUserNS indicates the program's main function calls
+// RunUserNSHolder, so its binary is able to hold the user namespaces of
+// ID-mapped mounts.
+var canHoldUserNS bool
+
+// RunUserNSHolder holds a user namespace for the parent process and then
+// exits if the process was executed for that purpose, otherwise it
+// returns. It must be called at the start of the program's main function
+// for ID-mapped mounts to be supported.
+func RunUserNSHolder() {
+	if os.Getenv(userNSHolderEnv) != "true" {
+		canHoldUserNS = true
+		return
+	}
+	// A process that holds a user namespace exits when its parent closes
+	// its standard input.
+	io.Copy(ioutil.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+// atFDCWD is AT_FDCWD. It is a variable so that it may be converted to a
+// uintptr.
+var atFDCWD = -0x64
+
+// mountAttr is the argument of mount_setattr(2).
+type mountAttr struct {
+	attrSet     uint64
+	attrClr     uint64
+	propagation uint64
+	userNS      uint64
+}
+
+// idMappedBindMount bind mounts the source to the target as an ID-mapped
+// mount. The mapping is applied with a user namespace that is created
+// for this purpose. A FailedPrecondition error is returned if the
+// kernel does not support ID-mapped mounts of the source's file system,
+// or if the program does not call RunUserNSHolder.
+func idMappedBindMount(
+	ctx context.Context, source, target string, m *idMapping) error {
+
+	if !canHoldUserNS {
+		return status.Error(codes.FailedPrecondition,
+			"id-mapped mounts unsupported: no user namespace holder")
+	}
+
+	userNS, err := newUserNS(m)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"failed to create user namespace: %v", err)
+	}
+	defer userNS.Close()
+
+	fields := map[string]interface{}{
+		"source": source,
+		"target": target,
+		"uidMap": m.uids,
+		"gidMap": m.gids,
+	}
+	log.WithFields(fields).Info("id-mapped bind mount")
+
+	// Clone the source's mount.
+	treeFD, err := openTree(source)
+	if err != nil {
+		return idMapError("open_tree", source, err)
+	}
+	defer syscall.Close(treeFD)
+
+	// Apply the user namespace's mapping to the clone.
+	attr := &mountAttr{
+		attrSet: mountAttrIDMap,
+		userNS:  uint64(userNS.Fd()),
+	}
+	if err := mountSetattr(treeFD, attr); err != nil {
+		return idMapError("mount_setattr", source, err)
+	}
+
+	// Attach the clone to the target.
+	if err := moveMount(treeFD, target); err != nil {
+		return idMapError("move_mount", target, err)
+	}
+	return nil
+}
+
+// idMapError returns a FailedPrecondition error if the error indicates
+// the kernel or file system does not support ID-mapped mounts, otherwise
+// an Internal error.
+func idMapError(op, path string, err error) error {
+	switch err {
+	case syscall.ENOSYS, syscall.EINVAL, syscall.EOPNOTSUPP:
+		return status.Errorf(codes.FailedPrecondition,
+			"id-mapped mounts unsupported: %s: %s: %v", op, path, err)
+	}
+	return status.Errorf(codes.Internal,
+		"id-mapped mount failed: %s: %s: %v", op, path, err)
+}
+
+// newUserNS returns a file descriptor of a new user namespace with the
+// ID mapping. The namespace is created by a short-lived child process
+// whose mappings are written before it executes and that exits after
+// the namespace is opened. The child process runs the plug-in's own
+// binary, which holds the namespace instead of running the plug-in, so
+// no other program is required. The namespace remains valid for as long
+// as the returned file is open.
+func newUserNS(m *idMapping) (*os.File, error) {
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = []string{userNSHolderEnv + "=true"}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: toSysProcIDMap(m.uids),
+		GidMappings: toSysProcIDMap(m.gids),
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+}
+
+func toSysProcIDMap(a []idRange) []syscall.SysProcIDMap {
+	m := make([]syscall.SysProcIDMap, len(a))
+	for i, r := range a {
+		m[i] = syscall.SysProcIDMap{
+			ContainerID: int(r.fileID),
+			HostID:      int(r.mountID),
+			Size:        int(r.count),
+		}
+	}
+	return m
+}
+
+func openTree(path string) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	fd, _, errno := syscall.Syscall(sysOpenTree,
+		uintptr(atFDCWD), uintptr(unsafe.Pointer(p)),
+		uintptr(openTreeClone|openTreeCloexec))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func mountSetattr(fd int, attr *mountAttr) error {
+	p, err := syscall.BytePtrFromString("")
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(sysMountSetattr,
+		uintptr(fd), uintptr(unsafe.Pointer(p)), uintptr(atEmptyPath),
+		uintptr(unsafe.Pointer(attr)), uintptr(mountAttrSizeVersion), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func moveMount(fd int, target string) error {
+	from, err := syscall.BytePtrFromString("")
+	if err != nil {
+		return err
+	}
+	to, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(sysMoveMount,
+		uintptr(fd), uintptr(unsafe.Pointer(from)),
+		uintptr(atFDCWD), uintptr(unsafe.Pointer(to)),
+		uintptr(moveMountFEmptyPath), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"context"
+	"runtime"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RunUserNSHolder returns immediately since ID-mapped mounts are only
+// supported on Linux.
+func RunUserNSHolder() {}
+
+// idMappedBindMount returns a FailedPrecondition error since ID-mapped
+// mounts are only supported on Linux.
+func idMappedBindMount(
+	ctx context.Context, source, target string, m *idMapping) error {
+
+	return status.Errorf(codes.FailedPrecondition,
+		"id-mapped mounts unsupported: %s", runtime.GOOS)
+}
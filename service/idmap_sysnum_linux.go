@@ -0,0 +1,13 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package service
+
+// The numbers of the system calls used to create ID-mapped mounts. These
+// system calls have the same numbers on every architecture except MIPS,
+// whose ABIs offset them.
+const (
+	sysOpenTree     = 428
+	sysMoveMount    = 429
+	sysMountSetattr = 442
+)
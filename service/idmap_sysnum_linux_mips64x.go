@@ -0,0 +1,13 @@
+//go:build linux && (mips64 || mips64le)
+// +build linux
+// +build mips64 mips64le
+
+package service
+
+// The numbers of the system calls used to create ID-mapped mounts. The
+// n64 ABI offsets the generic numbers by 5000.
+const (
+	sysOpenTree     = 5428
+	sysMoveMount    = 5429
+	sysMountSetattr = 5442
+)
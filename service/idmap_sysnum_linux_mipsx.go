@@ -0,0 +1,13 @@
+//go:build linux && (mips || mipsle)
+// +build linux
+// +build mips mipsle
+
+package service
+
+// The numbers of the system calls used to create ID-mapped mounts. The
+// o32 ABI offsets the generic numbers by 4000.
+const (
+	sysOpenTree     = 4428
+	sysMoveMount    = 4429
+	sysMountSetattr = 4442
+)
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestGetIDMapping(t *testing.T) {
+	tests := []struct {
+		desc    string
+		attribs map[string]string
+		want    *idMapping
+		code    codes.Code
+	}{
+		{
+			desc: "no mapping",
+		},
+		{
+			desc:    "empty mappings",
+			attribs: map[string]string{attribUIDMap: "", attribGIDMap: " , "},
+		},
+		{
+			desc:    "uid mapping",
+			attribs: map[string]string{attribUIDMap: "0:1000:1"},
+			want: &idMapping{
+				uids: []idRange{{0, 1000, 1}},
+				gids: identityIDMap,
+			},
+		},
+		{
+			desc:    "gid mapping",
+			attribs: map[string]string{attribGIDMap: "100:2000:10"},
+			want: &idMapping{
+				uids: identityIDMap,
+				gids: []idRange{{100, 2000, 10}},
+			},
+		},
+		{
+			desc: "comma and space separated ranges",
+			attribs: map[string]string{
+				attribUIDMap: "0:1000:1, 1:100000:65536",
+				attribGIDMap: "0:1000:1 1:100000:65536",
+			},
+			want: &idMapping{
+				uids: []idRange{{0, 1000, 1}, {1, 100000, 65536}},
+				gids: []idRange{{0, 1000, 1}, {1, 100000, 65536}},
+			},
+		},
+		{
+			desc:    "largest IDs",
+			attribs: map[string]string{attribUIDMap: "4294967295:0:4294967295"},
+			want: &idMapping{
+				uids: []idRange{{1<<32 - 1, 0, 1<<32 - 1}},
+				gids: identityIDMap,
+			},
+		},
+		{
+			desc:    "too few fields",
+			attribs: map[string]string{attribUIDMap: "0:1000"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc:    "too many fields",
+			attribs: map[string]string{attribGIDMap: "0:1000:1:1"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc:    "zero count",
+			attribs: map[string]string{attribUIDMap: "0:1000:0"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc:    "negative ID",
+			attribs: map[string]string{attribUIDMap: "-1:1000:1"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc:    "ID out of range",
+			attribs: map[string]string{attribUIDMap: "4294967296:1000:1"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc:    "name instead of ID",
+			attribs: map[string]string{attribGIDMap: "root:1000:1"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			desc: "invalid range after valid range",
+			attribs: map[string]string{
+				attribUIDMap: "0:1000:1",
+				attribGIDMap: "0:1000:1,1:2",
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		got, err := getIDMapping(tt.attribs)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("%s: code %v, want %v: %v", tt.desc, code, tt.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	etcdsync "github.com/coreos/etcd/clientv3/concurrency"
+	log "github.com/sirupsen/logrus"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+const (
+	// leaderElectionFile elects the controller that holds an exclusive
+	// lock on a lease file in the data directory.
+	leaderElectionFile = "file"
+
+	// leaderElectionEtcd elects the controller using an etcd election.
+	leaderElectionEtcd = "etcd"
+
+	// leaderFileName is the name of the lease file used by the file
+	// leader election.
+	leaderFileName = "leader.lock"
+
+	// leaderRetryInterval is the amount of time a follower waits before
+	// it campaigns again to become the leader.
+	leaderRetryInterval = time.Second
+
+	// defaultLeaderTTL is the default TTL of an etcd leader's session.
+	defaultLeaderTTL = 60 * time.Second
+)
+
+// leaderElector elects one of several controllers as the leader. Only
+// the leader serves the mutating controller RPCs.
+type leaderElector interface {
+	// isLeader returns a flag indicating whether or not this process
+	// is the leader.
+	isLeader() bool
+
+	// term returns a channel that is closed when this process stops
+	// being the leader. A closed channel is returned if this process is
+	// not the leader.
+	term() <-chan struct{}
+}
+
+// leaderFlag is embedded by the leaderElector implementations to
+// record whether or not this process is the leader.
+type leaderFlag struct {
+	id     string
+	leader int32
+	termL  sync.Mutex
+	done   chan struct{}
+}
+
+func (l *leaderFlag) isLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+func (l *leaderFlag) term() <-chan struct{} {
+	l.termL.Lock()
+	defer l.termL.Unlock()
+	if l.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return l.done
+}
+
+func (l *leaderFlag) setLeader(leader bool) {
+	l.termL.Lock()
+	defer l.termL.Unlock()
+	v := int32(0)
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&l.leader, v) == v {
+		return
+	}
+	if leader {
+		l.done = make(chan struct{})
+	} else if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	log.WithFields(map[string]interface{}{
+		"id":     l.id,
+		"leader": leader,
+	}).Info("leader election")
+}
+
+// getLeaderID returns the value used to identify this process in a
+// leader election.
+func (s *service) getLeaderID() string {
+	return fmt.Sprintf("%s-%d", s.nodeID, os.Getpid())
+}
+
+// initLeaderElection starts the leader election configured with the
+// environment variable X_CSI_VFS_LEADER_ELECTION.
+func (s *service) initLeaderElection(ctx context.Context) error {
+	id := s.getLeaderID()
+	switch v := csictx.Getenv(ctx, EnvVarLeaderElection); strings.ToLower(v) {
+	case "":
+		return nil
+	case leaderElectionFile:
+		l, err := newFileLeader(ctx, id, s.data)
+		if err != nil {
+			return err
+		}
+		s.leader = l
+		log.WithFields(map[string]interface{}{
+			"id":   id,
+			"path": l.path,
+		}).Info("leader election")
+	case leaderElectionEtcd:
+		ttl := defaultLeaderTTL
+		if v, ok := csictx.LookupEnv(
+			ctx, EnvVarLeaderElectionTTL); ok && v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			ttl = t
+		}
+		client, prefix, err := s.getEtcdClient(ctx)
+		if err != nil {
+			return err
+		}
+		l := newEtcdLeader(ctx, id, client, prefix, ttl)
+		s.leader = l
+		log.WithFields(map[string]interface{}{
+			"id":     id,
+			"prefix": l.prefix,
+			"ttl":    ttl,
+		}).Info("leader election")
+	default:
+		return fmt.Errorf("invalid leader election: %s", v)
+	}
+	return nil
+}
+
+// isLeader returns a flag indicating whether or not this process may
+// serve the mutating controller RPCs. A process is always the leader
+// if leader election is disabled.
+func (s *service) isLeader() bool {
+	return s.leader == nil || s.leader.isLeader()
+}
+
+// leaderContext returns a context for work that only the leader may do,
+// which is cancelled when this process stops being the leader or the
+// returned function is called. The context is never cancelled by the
+// election if leader election is disabled.
+func (s *service) leaderContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if s.leader == nil {
+		return ctx, cancel
+	}
+	term := s.leader.term()
+	go func() {
+		select {
+		case <-term:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// fileLeader is a leaderElector that elects the process that holds an
+// exclusive lock on a lease file. The lock is released by the operating
+// system when the process exits, at which point a follower acquires it.
+type fileLeader struct {
+	leaderFlag
+	path string
+}
+
+// newFileLeader returns a new file leader elector that campaigns until
+// the context is cancelled.
+func newFileLeader(
+	ctx context.Context, id, dataDir string) (*fileLeader, error) {
+
+	l := &fileLeader{
+		leaderFlag: leaderFlag{id: id},
+		path:       path.Join(dataDir, leaderFileName),
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	go l.campaign(ctx, f)
+	return l, nil
+}
+
+func (l *fileLeader) campaign(ctx context.Context, f *os.File) {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			// Record the leader's ID in the lease file. The lock is
+			// held, and the file kept open, until the process exits.
+			if err := f.Truncate(0); err == nil {
+				f.WriteAt([]byte(l.id+"\n"), 0)
+			}
+			l.setLeader(true)
+			<-ctx.Done()
+			l.setLeader(false)
+			f.Close()
+			return
+		}
+		if err != syscall.EWOULDBLOCK {
+			log.WithError(err).WithField("path", l.path).Error(
+				"leader election failed")
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return
+		case <-time.After(leaderRetryInterval):
+		}
+	}
+}
+
+// etcdLeader is a leaderElector that elects the process using an etcd
+// election. Leadership is lost if the process's etcd session expires.
+type etcdLeader struct {
+	leaderFlag
+	client *etcd.Client
+	prefix string
+	ttl    int
+}
+
+// newEtcdLeader returns a new etcd leader elector that campaigns until
+// the context is cancelled.
+func newEtcdLeader(
+	ctx context.Context,
+	id string,
+	client *etcd.Client,
+	prefix string,
+	ttl time.Duration) *etcdLeader {
+
+	l := &etcdLeader{
+		leaderFlag: leaderFlag{id: id},
+		client:     client,
+		prefix:     path.Join(prefix, "leader"),
+		ttl:        int(ttl.Seconds()),
+	}
+	go l.campaign(ctx)
+	return l
+}
+
+func (l *etcdLeader) campaign(ctx context.Context) {
+	for {
+		if err := l.campaignOnce(ctx); err != nil {
+			log.WithError(err).WithField("prefix", l.prefix).Error(
+				"leader election failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRetryInterval):
+		}
+	}
+}
+
+// campaignOnce blocks until this process is elected and then until
+// its session expires or the context is cancelled.
+func (l *etcdLeader) campaignOnce(ctx context.Context) error {
+	opts := []etcdsync.SessionOption{etcdsync.WithContext(ctx)}
+	if l.ttl > 0 {
+		opts = append(opts, etcdsync.WithTTL(l.ttl))
+	}
+	sess, err := etcdsync.NewSession(l.client, opts...)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	if err := etcdsync.NewElection(sess, l.prefix).Campaign(
+		ctx, l.id); err != nil {
+		return err
+	}
+	l.setLeader(true)
+	defer l.setLeader(false)
+
+	select {
+	case <-sess.Done():
+	case <-ctx.Done():
+	}
+	return nil
+}
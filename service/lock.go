@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/akutz/gosync"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/middleware/serialvolume"
+)
+
+// fileLockRetryInterval is the amount of time a fileLock waits before
+// it tries again to obtain a lock held by another process.
+const fileLockRetryInterval = 10 * time.Millisecond
+
+// fileLockProvider is a gocsi serial volume lock provider that locks
+// volumes with flock(2) on lock files in a directory. Processes on the
+// same host that share the directory serialize access to the same
+// volumes. A lock held by a process that exits is released by the
+// operating system.
+type fileLockProvider struct {
+	dir string
+}
+
+// newFileLockProvider returns a new file lock provider that keeps its
+// lock files in the specified directory.
+func newFileLockProvider(dir string) (*fileLockProvider, error) {
+	for _, d := range []string{"id", "name", "snapshot", "create"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &fileLockProvider{dir: dir}, nil
+}
+
+func (p *fileLockProvider) GetLockWithID(
+	ctx context.Context, id string) (gosync.TryLocker, error) {
+
+	return p.getLock("id", id), nil
+}
+
+func (p *fileLockProvider) GetLockWithName(
+	ctx context.Context, name string) (gosync.TryLocker, error) {
+
+	return p.getLock("name", name), nil
+}
+
+// getLock returns a lock for the lock file named for the escaped key.
+// The suffix ensures keys such as ".." do not escape the directory.
+func (p *fileLockProvider) getLock(kind, key string) *fileLock {
+	return &fileLock{
+		path: path.Join(p.dir, kind, url.PathEscape(key)+".lock"),
+	}
+}
+
+// initFileLocks appends a serial volume interceptor that uses a file
+// lock provider to the storage plug-in's interceptors.
+func (s *service) initFileLocks(
+	ctx context.Context, sp *gocsi.StoragePlugin) error {
+
+	p, err := newFileLockProvider(path.Join(s.data, "locks"))
+	if err != nil {
+		return err
+	}
+	opts := []serialvolume.Option{serialvolume.WithLockProvider(p)}
+	fields := map[string]interface{}{"dir": p.dir}
+
+	if v, ok := csictx.LookupEnv(
+		ctx, gocsi.EnvVarSerialVolAccessTimeout); ok && v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, serialvolume.WithTimeout(t))
+		fields["timeout"] = t
+	}
+
+	sp.Interceptors = append(sp.Interceptors, serialvolume.New(opts...))
+	log.WithFields(fields).Info("enabled serial volume access file locks")
+	return nil
+}
+
+// hasFileLocks returns a flag that indicates whether or not serial volume
+// access file locks are enabled. Serial volume access is enabled if it is
+// not specified, as it is by default in the SP, since an Admin's
+// environment does not include the SP's defaults.
+func (s *service) hasFileLocks(ctx context.Context) bool {
+	serial := true
+	if v, ok := csictx.LookupEnv(
+		ctx, gocsi.EnvVarSerialVolAccess); ok && v != "" {
+		serial, _ = strconv.ParseBool(v)
+	}
+	return serial && s.getEnvBool(ctx, EnvVarFileLocks)
+}
+
+// lockVolume locks the volume with the specified ID for an administrative
+// operation when serial volume access file locks are enabled, so that the
+// operation does not race with the SP's requests for the same volume.
+// Otherwise the Admin holds the data directory's exclusive lock, so the
+// SP is not running. The returned function releases the lock.
+func (s *service) lockVolume(
+	ctx context.Context, id string) (func(), error) {
+
+	return s.lockFile(ctx, "id", id)
+}
+
+// lockSnapshot locks the snapshot with the specified ID for an
+// administrative operation when serial volume access file locks are
+// enabled. The returned function releases the lock.
+func (s *service) lockSnapshot(
+	ctx context.Context, id string) (func(), error) {
+
+	return s.lockFile(ctx, "snapshot", id)
+}
+
+// lockVolumeName locks the name of a new volume while its contents are
+// copied and it is created, so requests for the same name in this or
+// another process that shares the data directory do not copy contents
+// to the volume's directory at the same time. A request waits for the
+// lock until its context is done or, if it is specified, the serial
+// volume access timeout elapses, so that it then observes the volume
+// created by the request that held the lock. The lock is always taken,
+// whether or not serial volume access file locks are enabled, and is
+// not the lock the serial volume interceptor takes for the name. The
+// returned function releases the lock.
+func (s *service) lockVolumeName(
+	ctx context.Context, name string) (func(), error) {
+
+	p, err := newFileLockProvider(path.Join(s.data, "locks"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to create lock dir: %v", err)
+	}
+	timeout, err := getSerialVolAccessTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	l := p.getLock("create", name)
+	if !l.lockContext(ctx) {
+		return nil, status.Errorf(codes.Aborted, "pending: %s", name)
+	}
+	return l.Unlock, nil
+}
+
+// lockFile obtains the lock for the key if serial volume access file
+// locks are enabled.
+func (s *service) lockFile(
+	ctx context.Context, kind, key string) (func(), error) {
+
+	if !s.hasFileLocks(ctx) {
+		return func() {}, nil
+	}
+
+	p, err := newFileLockProvider(path.Join(s.data, "locks"))
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := getSerialVolAccessTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l := p.getLock(kind, key)
+	if !l.TryLock(timeout) {
+		return nil, status.Errorf(codes.Aborted, "pending: %s", key)
+	}
+	return l.Unlock, nil
+}
+
+// getSerialVolAccessTimeout returns the serial volume access timeout,
+// which is zero if it is not specified.
+func getSerialVolAccessTimeout(ctx context.Context) (time.Duration, error) {
+	v, ok := csictx.LookupEnv(ctx, gocsi.EnvVarSerialVolAccessTimeout)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// fileLock is a gosync.TryLocker that holds an exclusive flock(2) on
+// a lock file. The lock file is removed when the lock is released.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+func (l *fileLock) Lock() {
+	for {
+		if ok, _ := l.tryLock(); ok {
+			return
+		}
+		time.Sleep(fileLockRetryInterval)
+	}
+}
+
+func (l *fileLock) TryLock(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := l.tryLock()
+		if err != nil {
+			return false
+		}
+		if ok {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(fileLockRetryInterval)
+	}
+}
+
+// lockContext obtains the lock, waiting until the context is done.
+func (l *fileLock) lockContext(ctx context.Context) bool {
+	for {
+		ok, err := l.tryLock()
+		if err != nil {
+			return false
+		}
+		if ok {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(fileLockRetryInterval):
+		}
+	}
+}
+
+// tryLock makes a single attempt to lock the lock file.
+func (l *fileLock) tryLock() (bool, error) {
+	for {
+		f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return false, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return false, nil
+			}
+			return false, err
+		}
+
+		// The previous holder removes the lock file before it releases
+		// the lock, so the lock is only valid if the locked file is still
+		// the file at the lock path. Otherwise try again with the new file.
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return false, err
+		}
+		if pi, err := os.Stat(l.path); err == nil && os.SameFile(fi, pi) {
+			l.f = f
+			return true, nil
+		}
+		f.Close()
+	}
+}
+
+func (l *fileLock) Unlock() {
+	if l.f == nil {
+		panic("unlock of unlocked file lock: " + l.path)
+	}
+	os.Remove(l.path)
+	l.f.Close()
+	l.f = nil
+}
+
+// Close releases the lock if it is held.
+func (l *fileLock) Close() error {
+	if l.f != nil {
+		l.Unlock()
+	}
+	return nil
+}
@@ -68,3 +68,29 @@ func isVolumeCapabilitySupported(a ...*csi.VolumeCapability) error {
 	}
 	return nil
 }
+
+// requireLeader returns Unavailable for the mutating controller RPCs
+// if this process is not the leader of the controllers:
+//
+// * CreateVolume
+// * DeleteVolume
+// * ControllerPublishVolume
+// * ControllerUnpublishVolume
+func (s *service) requireLeader(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	switch req.(type) {
+	case *csi.CreateVolumeRequest,
+		*csi.DeleteVolumeRequest,
+		*csi.ControllerPublishVolumeRequest,
+		*csi.ControllerUnpublishVolumeRequest:
+		if !s.isLeader() {
+			return nil, status.Error(codes.Unavailable, "not the leader")
+		}
+	}
+
+	return handler(ctx, req)
+}
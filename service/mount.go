@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// mountOptCheck verifies that a per-mount option is present or absent
+// in a mount's options after a mount flag is applied.
+type mountOptCheck struct {
+	opt     string
+	present bool
+}
+
+// mountFlags are the MountVolume mount flags that may be applied to a
+// bind mount and the checks that verify each flag was applied. Only
+// per-mount flags are listed since a bind mount shares the superblock of
+// the volume's file system.
+var mountFlags = map[string][]mountOptCheck{
+	"ro":          {{"ro", true}},
+	"rw":          {{"ro", false}},
+	"nosuid":      {{"nosuid", true}},
+	"suid":        {{"nosuid", false}},
+	"nodev":       {{"nodev", true}},
+	"dev":         {{"nodev", false}},
+	"noexec":      {{"noexec", true}},
+	"exec":        {{"noexec", false}},
+	"noatime":     {{"noatime", true}},
+	"atime":       {{"noatime", false}},
+	"nodiratime":  {{"nodiratime", true}},
+	"diratime":    {{"nodiratime", false}},
+	"relatime":    {{"relatime", true}},
+	"norelatime":  {{"relatime", false}},
+	"strictatime": {{"noatime", false}, {"relatime", false}},
+	"nosymfollow": {{"nosymfollow", true}},
+}
+
+// defaultMountFlags is the default list of mount flags allowed in
+// NodePublishVolume requests.
+const defaultMountFlags = "ro,nosuid,suid,nodev,dev,noexec,exec," +
+	"noatime,atime,nodiratime,diratime,relatime,norelatime,strictatime"
+
+// parseMountFlags returns the set of allowed mount flags from the
+// comma-separated allow and deny lists. An error is returned if the
+// allow list includes a flag that cannot be applied to a bind mount.
+func parseMountFlags(allow, deny string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, f := range strings.Split(allow, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if _, ok := mountFlags[f]; !ok {
+			return nil, fmt.Errorf("invalid mount flag: %s", f)
+		}
+		flags[f] = true
+	}
+	for _, f := range strings.Split(deny, ",") {
+		delete(flags, strings.TrimSpace(f))
+	}
+	return flags, nil
+}
+
+// getMountFlags returns the mount flags of a volume capability. An
+// InvalidArgument error is returned if a flag is not allowed.
+func (s *service) getMountFlags(cap *csi.VolumeCapability) ([]string, error) {
+	mnt := cap.GetMount()
+	if mnt == nil {
+		return nil, nil
+	}
+	var flags []string
+	for _, f := range mnt.MountFlags {
+		if !s.mountFlags[f] {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"mount flag not allowed: %s", f)
+		}
+		flags = append(flags, f)
+	}
+	return gofsutil.RemoveDuplicates(flags), nil
+}
+
+// getMountOpts returns the options of a target's bind mount from the
+// request's ReadOnly field, access mode, and mount flags.
+func (s *service) getMountOpts(
+	req *csi.NodePublishVolumeRequest) ([]string, error) {
+
+	flags, err := s.getMountFlags(req.VolumeCapability)
+	if err != nil {
+		return nil, err
+	}
+	opts := []string{"rw"}
+	if am := req.VolumeCapability.AccessMode; req.Readonly || (am != nil &&
+		am.Mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY) {
+		opts[0] = "ro"
+	}
+	for _, f := range flags {
+		switch f {
+		case "ro":
+			opts[0] = "ro"
+		case "rw":
+			if opts[0] == "ro" {
+				return nil, status.Error(codes.InvalidArgument,
+					"mount flag rw conflicts with read-only access")
+			}
+		default:
+			opts = append(opts, f)
+		}
+	}
+	return opts, nil
+}
+
+// withoutMountFlags returns copies of the volume capabilities without
+// their mount flags.
+func withoutMountFlags(
+	caps ...*csi.VolumeCapability) []*csi.VolumeCapability {
+
+	a := make([]*csi.VolumeCapability, len(caps))
+	for i, cap := range caps {
+		mnt := cap.GetMount()
+		if mnt == nil || len(mnt.MountFlags) == 0 {
+			a[i] = cap
+			continue
+		}
+		a[i] = &csi.VolumeCapability{
+			AccessMode: cap.AccessMode,
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType: mnt.FsType,
+				},
+			},
+		}
+	}
+	return a
+}
+
+// bindMountTarget bind mounts the source to the target and applies the
+// options. The target is unmounted if the options could not be applied.
+func bindMountTarget(
+	ctx context.Context, source, target string, opts ...string) error {
+
+	if runtime.GOOS != "linux" {
+		return gofsutil.BindMount(ctx, source, target, opts...)
+	}
+
+	if err := gofsutil.BindMount(ctx, source, target); err != nil {
+		return err
+	}
+	if err := ensureMountOpts(ctx, target, opts...); err != nil {
+		gofsutil.Unmount(ctx, target)
+		return err
+	}
+	return nil
+}
+
+// ensureMountOpts applies the options to the target's bind mount on
+// Linux if they are not in effect. The options are applied by remounting
+// the bind mount with the "bind" option, which changes only the flags of
+// the bind mount and not of the volume's file system. The options are
+// then verified against the target's entry in the mount table, and the
+// remount is tried once more if the options are still not in effect.
+func ensureMountOpts(ctx context.Context, target string, opts ...string) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	err := verifyMountOpts(ctx, target, opts...)
+	for i := 0; err != nil && i < 2; i++ {
+		if err := remountBind(ctx, target, opts...); err != nil {
+			return err
+		}
+		if err = verifyMountOpts(ctx, target, opts...); err != nil {
+			log.WithField("path", target).WithError(err).Warn(
+				"mount verification failed")
+		}
+	}
+	return err
+}
+
+// remountBind remounts the target's bind mount with the options.
+func remountBind(ctx context.Context, target string, opts ...string) error {
+	args := []string{"-o", strings.Join(
+		append([]string{"remount", "bind"}, opts...), ","), target}
+	f := log.Fields{"cmd": "mount", "args": strings.Join(args, " ")}
+	log.WithFields(f).Info("mount command")
+	if buf, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("remount failed: %v\noutput: %s", err, buf)
+	}
+	return nil
+}
+
+// verifyMountOpts verifies the mount flags were applied to the target's
+// most recent entry in the mount table. The target is looked up by its
+// mount point alone, since its source depends on the file system of the
+// volume's directory.
+func verifyMountOpts(ctx context.Context, target string, flags ...string) error {
+	minfo, err := getAllMounts(ctx)
+	if err != nil {
+		return err
+	}
+	var mntOpts map[string]bool
+	for _, i := range minfo {
+		if i.Path == target {
+			mntOpts = map[string]bool{}
+			for _, o := range i.Opts {
+				mntOpts[o] = true
+			}
+		}
+	}
+	if mntOpts == nil {
+		return fmt.Errorf("mount not found: %s", target)
+	}
+	for _, f := range flags {
+		for _, c := range mountFlags[f] {
+			if mntOpts[c.opt] != c.present {
+				return fmt.Errorf("mount flag not applied: %s: %s", target, f)
+			}
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -22,15 +23,17 @@ func (s *service) NodePublishVolume(
 	*csi.NodePublishVolumeResponse, error) {
 
 	// Get the existing volume info.
-	vol, err := s.getVolume(req.VolumeId)
+	vol, err := s.getVolume(ctx, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
 
 	// Verify that the requested capability is compatible with the volume's
-	// capabilities.
+	// capabilities. Mount flags are applied when the volume is published
+	// and are not compared.
 	if ok, err := csiutils.IsVolumeCapabilityCompatible(
-		req.VolumeCapability, vol.VolumeCapabilities); !ok {
+		withoutMountFlags(req.VolumeCapability)[0],
+		withoutMountFlags(vol.VolumeCapabilities...)); !ok {
 		if err != nil {
 			return nil, err
 		}
@@ -38,9 +41,68 @@ func (s *service) NodePublishVolume(
 			codes.InvalidArgument, "invalid volume capability")
 	}
 
-	// Get the path of the volume.
-	devPath := path.Join(s.dev, req.VolumeId)
-	mntPath := path.Join(s.mnt, req.VolumeId)
+	// Get the target's bind mount options from the request's ReadOnly
+	// field, access mode, and mount flags.
+	opts, err := s.getMountOpts(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get whether the volume is published to an overlay target, whose
+	// writes never reach the volume.
+	overlay, err := isOverlay(req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// A sealed volume is always published read-only, except to an
+	// overlay target.
+	if !vol.sealed.IsZero() && !overlay {
+		opts[0] = "ro"
+	}
+
+	// Get the group ID applied to the volume's files, if any.
+	fsGroup, err := getFSGroup(req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the ID mapping of the target's mount, if any.
+	idMap, err := getIDMapping(req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the key of an encrypted volume from the request's credentials.
+	var key []byte
+	encrypted, err := isEncrypted(vol.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if key, err = getEncryptionKey(req.NodePublishCredentials); err != nil {
+			return nil, err
+		}
+	}
+	if overlay {
+		if err := checkOverlay(req.VolumeId, encrypted, idMap); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the key of the target's subdirectory of the volume, if any.
+	subdir, err := getSubdirKey(req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+	if subdir != "" && overlay {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"overlay targets of subdirs unsupported: %s", req.VolumeId)
+	}
+	srcPath := vol.path
+	if subdir != "" {
+		srcPath = path.Join(vol.path, subdir)
+	}
 
 	// Eval any symlinks in the target path and ensure the CO has created it.
 	tgtPath := req.TargetPath
@@ -55,6 +117,39 @@ func (s *service) NodePublishVolume(
 		return nil, status.Error(codes.NotFound, tgtPath)
 	}
 
+	// The files of a projected volume are written to a tmpfs mounted to
+	// the target instead of bind mounting the volume's directory.
+	projected, err := isProjected(vol.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if projected {
+		if idMap != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"ID-mapped mounts of projected volumes unsupported: %s",
+				req.VolumeId)
+		}
+		return s.publishProjected(ctx, req, vol, tgtPath, opts, fsGroup)
+	}
+
+	// Get the path of the volume's device from the request's publish
+	// info and the path of the volume's private mount.
+	devPath, err := s.getPublishedDevPath(ctx, req, vol)
+	if err != nil {
+		return nil, err
+	}
+	mntPath := path.Join(s.mnt, req.VolumeId)
+
+	// A process that serves only the node service mounts the volume's
+	// device if the controller did not.
+	nodeDevice := false
+	if s.mode == modeNode && devPath == path.Join(s.dev, req.VolumeId) {
+		if err := s.mountDevice(ctx, vol.path, devPath); err != nil {
+			return nil, err
+		}
+		nodeDevice = true
+	}
+
 	// Get the path of the volume's device and see if it exists.
 	if ok, err := fileExists(devPath); !ok {
 		if err != nil {
@@ -85,7 +180,22 @@ func (s *service) NodePublishVolume(
 	}
 	isPrivMounted := false
 	for _, i := range minfo {
-		if i.Source == vol.path && i.Path == tgtPath {
+		if i.Source == srcPath && i.Path == tgtPath {
+			// The volume is already published to the target. Ensure the
+			// requested options, such as read-only, are still in effect.
+			if err := ensureMountOpts(ctx, tgtPath, opts...); err != nil {
+				gofsutil.Unmount(ctx, tgtPath)
+				return nil, status.Errorf(codes.Internal,
+					"target mount verification failed: %s: %v", tgtPath, err)
+			}
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		if isOverlayMount(i, req.VolumeId) && i.Path == tgtPath {
+			if err := ensureMountOpts(ctx, tgtPath, opts...); err != nil {
+				gofsutil.Unmount(ctx, tgtPath)
+				return nil, status.Errorf(codes.Internal,
+					"target mount verification failed: %s: %v", tgtPath, err)
+			}
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 		if i.Source == vol.path && i.Path == mntPath {
@@ -93,30 +203,85 @@ func (s *service) NodePublishVolume(
 		}
 	}
 
+	// Add the key of an encrypted volume to the keyring of the volume's
+	// filesystem before the volume is mounted. NodeUnpublishVolume
+	// removes the key when the volume's last target is unpublished.
+	var keyID string
+	if key != nil {
+		id, err := addVolumeKey(vol.path, key)
+		if err != nil {
+			return nil, err
+		}
+		keyID = id.String()
+	}
+
 	// If the devie is not already mounted into the private mount
-	// area then go ahead and mount it.
+	// area then go ahead and mount it. The device path is recorded so
+	// NodeUnpublishVolume is able to distinguish the device's mount
+	// from the volume's target mounts.
 	if !isPrivMounted {
 		if err := gofsutil.BindMount(ctx, devPath, mntPath); err != nil {
 			return nil, status.Errorf(codes.Internal,
 				"bind mount failed: devPath=%s, mntPath=%s: %v",
 				devPath, mntPath, err)
 		}
+		if err := s.saveNodePublishInfo(&nodePublishInfo{
+			VolumeID:   req.VolumeId,
+			DevPath:    devPath,
+			NodeDevice: nodeDevice,
+			KeyID:      keyID,
+		}); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create the bind mount options from the requet's ReadOnly field
-	// and access mode.
-	opts := []string{"rw"}
-	if am := req.VolumeCapability.AccessMode; req.Readonly || (am != nil &&
-		am.Mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY) {
-		opts[0] = "ro"
+	// Mount an overlay to the target whose lower layer is the private
+	// mount. The fsGroup is applied to the target's scratch layer.
+	if overlay {
+		return s.publishOverlay(
+			ctx, req.VolumeId, mntPath, tgtPath, opts, fsGroup)
 	}
 
-	// Bind mount the private mount to the requested target path with
-	// the requested access mode.
-	if err := gofsutil.BindMount(ctx, mntPath, tgtPath, opts...); err != nil {
+	// Create the target's subdirectory of the volume if it does not
+	// exist. The subdirectory is published instead of the volume's root.
+	tgtSrc := mntPath
+	if subdir != "" {
+		if tgtSrc, err = mkSubdir(mntPath, subdir); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the fsGroup to the files of the volume or the target's
+	// subdirectory unless the volume is published read-only.
+	if fsGroup >= 0 && opts[0] != "ro" {
+		if err := applyFSGroup(tgtSrc, fsGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	// If an ID mapping is requested then bind mount the private mount,
+	// or the target's subdirectory of it, to the requested target path
+	// as an ID-mapped mount and then apply the requested access mode and
+	// mount flags.
+	if idMap != nil {
+		if err := idMappedBindMount(ctx, tgtSrc, tgtPath, idMap); err != nil {
+			return nil, err
+		}
+		if err := ensureMountOpts(ctx, tgtPath, opts...); err != nil {
+			gofsutil.Unmount(ctx, tgtPath)
+			return nil, status.Errorf(codes.Internal,
+				"target mount verification failed: %s: %v", tgtPath, err)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Bind mount the private mount, or the target's subdirectory of it,
+	// to the requested target path with the requested access mode and
+	// mount flags.
+	if err := bindMountTarget(ctx, tgtSrc, tgtPath, opts...); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"bind mount failed: mntPath=%s, tgtPath=%s, opts=%v: %v",
-			mntPath, tgtPath, opts, err)
+			tgtSrc, tgtPath, opts, err)
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -136,8 +301,43 @@ func (s *service) NodeUnpublishVolume(
 		return nil, status.Error(codes.NotFound, volPath)
 	}
 
-	// Get the path of the volume.
+	// Unmount the tmpfs of a projected volume's target. A projected
+	// volume's directory is never mounted.
+	vol, err := s.store.getVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		projected, err := isProjected(vol.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		if projected {
+			tgtPath := req.TargetPath
+			if err := gofsutil.EvalSymlinks(ctx, &tgtPath); err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"failed to eval symlink: %s: %v", tgtPath, err)
+			}
+			if err := s.unpublishProjected(
+				ctx, req.VolumeId, tgtPath); err != nil {
+				return nil, err
+			}
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+	}
+
+	// Get the path of the volume's device from the record persisted by
+	// NodePublishVolume, falling back to the node's device directory.
 	devPath := path.Join(s.dev, req.VolumeId)
+	pubInfo, err := s.getNodePublishInfo(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if pubInfo != nil && pubInfo.DevPath != "" {
+		devPath = pubInfo.DevPath
+	}
+
+	// Get the path of the volume.
 	mntPath := path.Join(s.mnt, req.VolumeId)
 	tgtPath := req.TargetPath
 	if err := gofsutil.EvalSymlinks(ctx, &tgtPath); err != nil {
@@ -156,28 +356,77 @@ func (s *service) NodeUnpublishVolume(
 	//
 	//   1. It unmounts the target path if it is mounted.
 	//   2. It counts how many times the volume is mounted.
+	//
+	// An overlay target counts as a mount of the volume since the
+	// volume's private mount is the overlay's lower layer, and a target
+	// of a subdirectory counts since its source is in the volume. The
+	// keys of the subdirectories of the other targets are recorded as
+	// well.
 	mountCount := 0
+	var subdirs []string
+	subdir := ""
 	for _, i := range minfo {
 
+		if isOverlayMount(i, req.VolumeId) {
+			if i.Path != tgtPath {
+				mountCount++
+				continue
+			}
+			if err := gofsutil.Unmount(ctx, tgtPath); err != nil {
+				return nil, status.Errorf(
+					codes.Internal, "unmount failed: %s: %v", tgtPath, err)
+			}
+			continue
+		}
+
+		// Get the key of the subdirectory that is the entry's source.
+		key := ""
+		if strings.HasPrefix(i.Source, volPath+"/") {
+			key = strings.TrimPrefix(i.Source, volPath+"/")
+		} else if i.Source != volPath {
+			continue
+		}
+
 		// If there is an entry that matches the volPath value that
 		// isn't the dev or mnt paths then increment the number of
 		// times this volume is mounted on this node.
-		if i.Source == volPath && (i.Path != devPath && i.Path != mntPath) {
+		if i.Path != devPath && i.Path != mntPath {
 			mountCount++
+			if key != "" && i.Path != tgtPath {
+				subdirs = append(subdirs, key)
+			}
 		}
 
 		// If there is an entry that matches the volPath value and
 		// a path that matches the tgtPath value then unmount it as
 		// it is the subject of this request.
-		if i.Source == volPath && i.Path == tgtPath {
+		if i.Path == tgtPath {
 			if err := gofsutil.Unmount(ctx, tgtPath); err != nil {
 				return nil, status.Errorf(
 					codes.Internal, "unmount failed: %s: %v", tgtPath, err)
 			}
 			mountCount--
+			if key != "" {
+				subdir = key
+			}
+		}
+	}
+
+	// Apply the volume's subdirectory policy if the target was the last
+	// target of its subdirectory, or of a subdirectory nested in it.
+	if subdir != "" && !isSubdirInUse(subdir, subdirs) {
+		if err := applySubdirPolicy(ctx, vol, volPath, subdir); err != nil {
+			return nil, err
 		}
 	}
 
+	// Discard the target's scratch layer if it was an overlay target.
+	scratch := s.getOverlayTargetDir(req.VolumeId, tgtPath)
+	if err := os.RemoveAll(scratch); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to remove scratch layer: %s: %v", scratch, err)
+	}
+
 	log.WithFields(map[string]interface{}{
 		"name":  req.VolumeId,
 		"count": mountCount,
@@ -196,6 +445,24 @@ func (s *service) NodeUnpublishVolume(
 				codes.Internal,
 				"remove private mnt failed: %s: %v", mntPath, err)
 		}
+		overlayDir := s.getOverlayDir(req.VolumeId)
+		if err := os.RemoveAll(overlayDir); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to remove scratch layers: %s: %v", overlayDir, err)
+		}
+		if pubInfo != nil && pubInfo.NodeDevice {
+			if err := s.unmountDevice(ctx, volPath, devPath); err != nil {
+				return nil, err
+			}
+		}
+		if pubInfo != nil && pubInfo.KeyID != "" {
+			if err := removeVolumeKey(volPath, pubInfo.KeyID); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.removeNodePublishInfo(req.VolumeId); err != nil {
+			return nil, err
+		}
 	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -206,12 +473,7 @@ func (s *service) NodeGetId(
 	req *csi.NodeGetIdRequest) (
 	*csi.NodeGetIdResponse, error) {
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		return nil, err
-	}
-
-	return &csi.NodeGetIdResponse{NodeId: hostname}, nil
+	return &csi.NodeGetIdResponse{NodeId: s.nodeID}, nil
 }
 
 func (s *service) NodeProbe(
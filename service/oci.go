@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramOCILayout is the CreateVolume parameter that specifies the
+	// absolute path of a local OCI image layout directory or oci-archive
+	// whose image's root filesystem is extracted to a new volume.
+	paramOCILayout = "ociLayout"
+
+	// paramOCIRef is the CreateVolume parameter that specifies the
+	// reference name of the image in an OCI image layout.
+	paramOCIRef = "ociRef"
+
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	ociIndexMediaType   = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// ociMaxJSONSize is the largest index or manifest that is read.
+	ociMaxJSONSize = 4 << 20
+
+	// ociMaxIndexDepth is the largest number of nested indexes that are
+	// followed to an image's manifest.
+	ociMaxIndexDepth = 4
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ociLayout is an OCI image layout directory.
+type ociLayout struct {
+	dir  string
+	name string
+}
+
+// extractImage extracts the root filesystem of an image in a local OCI
+// image layout to the directory of a new volume. The image's layers are
+// extracted in order, and the whiteout entries of a layer remove the
+// files of earlier layers. The layout must be inside of the content root,
+// and may be a directory or an oci-archive, which is a tar archive of a
+// layout directory. The total size of the image's regular files may not
+// exceed the volume's capacity unless the capacity is zero.
+func (s *service) extractImage(
+	ctx context.Context,
+	layout, ref, volPath string,
+	capacityBytes int64) error {
+
+	p, err := s.getContentPath(paramOCILayout, "image layout", layout)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to stat image layout: %s: %v", layout, err)
+	}
+
+	l := &ociLayout{dir: p, name: layout}
+	if !fi.IsDir() {
+		// The blobs of an oci-archive are read in the order of the
+		// image's manifest, so the archive is first extracted to a
+		// temporary directory.
+		tmp, err := ioutil.TempDir(s.data, ".oci-")
+		if err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmp)
+		f, err := os.Open(p)
+		if err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to open image layout: %s: %v", layout, err)
+		}
+		err = s.extractStream(ctx, &tarExtractor{root: tmp}, f, layout)
+		f.Close()
+		if err != nil {
+			return extractError(layout, err)
+		}
+		l.dir = tmp
+	}
+
+	m, err := l.manifest(ref)
+	if err != nil {
+		return err
+	}
+
+	// Remove the files of an earlier attempt so they do not count
+	// against the volume's capacity.
+	if err := clearDir(volPath, infoFileName); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to clear volume: %s: %v", volPath, err)
+	}
+	x := &tarExtractor{root: volPath, limit: capacityBytes}
+	for _, desc := range m.Layers {
+		b, err := l.openBlob(desc)
+		if err != nil {
+			return err
+		}
+		x.layer = map[string]bool{}
+		err = s.extractStream(ctx, x, b, desc.Digest)
+		if err == nil {
+			err = b.verify()
+		}
+		b.Close()
+		if err != nil {
+			return extractError(desc.Digest, err)
+		}
+	}
+	if err := x.finish(); err != nil {
+		return extractError(layout, err)
+	}
+
+	log.WithFields(map[string]interface{}{
+		"layout": layout,
+		"ref":    ref,
+		"layers": len(m.Layers),
+		"path":   volPath,
+		"size":   x.size,
+	}).Info("extracted image")
+	return nil
+}
+
+// manifest returns the manifest of the image in the layout with the
+// specified reference name. The reference may be empty if the layout's
+// index has one image. An image index is resolved to the manifest for
+// the host's platform.
+func (l *ociLayout) manifest(ref string) (*ociManifest, error) {
+	var layout struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	buf, err := l.readFile("oci-layout")
+	if err == nil {
+		err = json.Unmarshal(buf, &layout)
+	}
+	if err != nil || layout.Version == "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid image layout: %s", l.name)
+	}
+
+	var idx ociIndex
+	buf, err = l.readFile("index.json")
+	if err == nil {
+		err = json.Unmarshal(buf, &idx)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid image layout index: %s: %v", l.name, err)
+	}
+
+	descs := idx.Manifests
+	if ref != "" {
+		descs = nil
+		for _, desc := range idx.Manifests {
+			if desc.Annotations[ociRefNameAnnotation] == ref {
+				descs = append(descs, desc)
+			}
+		}
+		if len(descs) == 0 {
+			return nil, status.Errorf(codes.NotFound,
+				"image reference: %s: %s", l.name, ref)
+		}
+	}
+	desc, err := selectManifest(descs, l.name, ref == "")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; isIndexMediaType(desc.MediaType); i++ {
+		if i == ociMaxIndexDepth {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"image indexes nested too deeply: %s", l.name)
+		}
+		var idx ociIndex
+		if err := l.readJSON(desc, &idx); err != nil {
+			return nil, err
+		}
+		if desc, err = selectManifest(idx.Manifests, l.name, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var m ociManifest
+	if err := l.readJSON(desc, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// selectManifest returns the only descriptor in a list, or else the
+// descriptor for the host's platform. If byRef is true then a list with
+// more than one descriptor without platforms requires a reference name.
+func selectManifest(
+	descs []ociDescriptor, name string, byRef bool) (ociDescriptor, error) {
+
+	if len(descs) == 1 {
+		return descs[0], nil
+	}
+	if len(descs) == 0 {
+		return ociDescriptor{}, status.Errorf(codes.InvalidArgument,
+			"image layout has no manifests: %s", name)
+	}
+	var hasPlatform bool
+	for _, desc := range descs {
+		if p := desc.Platform; p != nil {
+			hasPlatform = true
+			if p.OS == runtime.GOOS && p.Architecture == runtime.GOARCH {
+				return desc, nil
+			}
+		}
+	}
+	if byRef && !hasPlatform {
+		return ociDescriptor{}, status.Errorf(codes.InvalidArgument,
+			"image layout has %d images: %s: param %s required",
+			len(descs), name, paramOCIRef)
+	}
+	return ociDescriptor{}, status.Errorf(codes.NotFound,
+		"image for platform %s/%s: %s", runtime.GOOS, runtime.GOARCH, name)
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ociIndexMediaType || mediaType == dockerListMediaType
+}
+
+// readJSON reads the JSON blob of a descriptor into v.
+func (l *ociLayout) readJSON(desc ociDescriptor, v interface{}) error {
+	if desc.Size > ociMaxJSONSize {
+		return status.Errorf(codes.InvalidArgument,
+			"image blob too large: %s: %d", desc.Digest, desc.Size)
+	}
+	b, err := l.openBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(b, ociMaxJSONSize))
+	if err == nil {
+		err = b.verify()
+	}
+	if err != nil {
+		return extractError(desc.Digest, err)
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid image blob: %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// open opens the file with the specified path in the layout's directory.
+// The file's symlinks are resolved, and a file outside of the layout's
+// directory is refused since the symlinks of an oci-archive are
+// extracted as they are.
+func (l *ociLayout) open(name string) (*os.File, error) {
+	p, err := filepath.EvalSymlinks(filepath.Join(l.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if !isPathWithin(l.dir, p) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"image layout file outside of layout: %s: %s", l.name, name)
+	}
+	return os.Open(p)
+}
+
+// readFile reads the file with the specified path in the layout's
+// directory.
+func (l *ociLayout) readFile(name string) ([]byte, error) {
+	f, err := l.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// ociBlob is a reader of a blob that computes the blob's digest and size
+// as it is read.
+type ociBlob struct {
+	f    *os.File
+	h    hash.Hash
+	n    int64
+	desc ociDescriptor
+}
+
+// openBlob opens the blob of a descriptor. The digest may only be a
+// sha256 or sha512 digest.
+func (l *ociLayout) openBlob(desc ociDescriptor) (*ociBlob, error) {
+	parts := strings.SplitN(desc.Digest, ":", 2)
+	var h hash.Hash
+	if len(parts) == 2 {
+		switch parts[0] {
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		}
+	}
+	if h == nil || len(parts[1]) != h.Size()*2 ||
+		strings.ToLower(parts[1]) != parts[1] {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid image digest: %q", desc.Digest)
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid image digest: %q", desc.Digest)
+	}
+
+	f, err := l.open(filepath.Join("blobs", parts[0], parts[1]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound,
+				"image blob: %s: %s", l.name, desc.Digest)
+		}
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to open image blob: %s: %v", desc.Digest, err)
+	}
+	return &ociBlob{f: f, h: h, desc: desc}, nil
+}
+
+func (b *ociBlob) Read(p []byte) (int, error) {
+	n, err := b.f.Read(p)
+	b.h.Write(p[:n])
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *ociBlob) Close() error {
+	return b.f.Close()
+}
+
+// verify reads the rest of the blob and returns an error if the blob's
+// digest or size does not match its descriptor.
+func (b *ociBlob) verify() error {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return err
+	}
+	digest := strings.SplitN(b.desc.Digest, ":", 2)[1]
+	if hex.EncodeToString(b.h.Sum(nil)) != digest || b.n != b.desc.Size {
+		return status.Errorf(codes.DataLoss,
+			"image blob does not match its digest and size: %s",
+			b.desc.Digest)
+	}
+	return nil
+}
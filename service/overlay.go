@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// attribOverlay is the volume attribute that indicates the volume is
+	// published to a target as an overlay mount. The volume's private
+	// mount is the overlay's read-only lower layer, and the target's
+	// writes go to a scratch layer that is discarded when the target is
+	// unpublished.
+	attribOverlay = "overlay"
+
+	// overlaySourcePrefix is the prefix of the source of the overlay
+	// mounts of a volume's targets.
+	overlaySourcePrefix = "csi-vfs-overlay:"
+)
+
+// isOverlay returns a flag that indicates whether the volume attributes
+// request an overlay target.
+func isOverlay(attribs map[string]string) (bool, error) {
+	v, ok := attribs[attribOverlay]
+	if !ok || v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"invalid attribute: %s=%s", attribOverlay, v)
+	}
+	return b, nil
+}
+
+// getOverlaySource returns the source of the overlay mounts of a
+// volume's targets, which identifies the mounts in the mount table.
+func getOverlaySource(volumeID string) string {
+	return overlaySourcePrefix + volumeID
+}
+
+// isOverlayMount returns a flag that indicates whether the mount table
+// entry is an overlay target of the volume.
+func isOverlayMount(i gofsutil.Info, volumeID string) bool {
+	return i.Type == "overlay" && i.Device == getOverlaySource(volumeID)
+}
+
+// getOverlayDir returns the path of the directory that contains the
+// scratch layers of a volume's overlay targets.
+func (s *service) getOverlayDir(volumeID string) string {
+	return path.Join(s.data, "overlay", volumeID)
+}
+
+// getOverlayTargetDir returns the path of the scratch layer of one of a
+// volume's overlay targets. The directory is named by the hash of the
+// target's path so it may be found again when the target is unpublished.
+func (s *service) getOverlayTargetDir(volumeID, tgtPath string) string {
+	sum := sha256.Sum256([]byte(tgtPath))
+	return path.Join(s.getOverlayDir(volumeID), hex.EncodeToString(sum[:]))
+}
+
+// publishOverlay mounts an overlay to the target whose lower layer is
+// the volume's private mount and whose upper and work directories are
+// a new scratch layer for the target. The root of the scratch layer has
+// the owner and mode of the volume's root directory, and the fsGroup is
+// applied to it instead of to the volume's files so that the volume is
+// never modified. The options of the target's mount are then applied.
+func (s *service) publishOverlay(
+	ctx context.Context,
+	volumeID, mntPath, tgtPath string,
+	opts []string,
+	fsGroup int) (*csi.NodePublishVolumeResponse, error) {
+
+	// The overlay's options separate the layers with colons and the
+	// options with commas.
+	if strings.ContainsAny(mntPath+s.data, ",:") {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"overlay targets unsupported by paths: %s, %s", mntPath, s.data)
+	}
+
+	// A scratch layer left by a target that was not unpublished is
+	// discarded.
+	dir := s.getOverlayTargetDir(volumeID, tgtPath)
+	upper, work := path.Join(dir, "upper"), path.Join(dir, "work")
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to remove scratch layer: %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(work, 0700); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to create scratch layer: %s: %v", dir, err)
+	}
+	if err := mkdirLike(upper, mntPath); err != nil {
+		os.RemoveAll(dir)
+		return nil, status.Errorf(codes.Internal,
+			"failed to create scratch layer: %s: %v", dir, err)
+	}
+	if fsGroup >= 0 {
+		if err := applyFSGroup(upper, fsGroup); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	if err := gofsutil.Mount(ctx, getOverlaySource(volumeID), tgtPath,
+		"overlay", "lowerdir="+mntPath, "upperdir="+upper,
+		"workdir="+work); err != nil {
+		os.RemoveAll(dir)
+		return nil, status.Errorf(codes.Internal,
+			"overlay mount failed: mntPath=%s, tgtPath=%s: %v",
+			mntPath, tgtPath, err)
+	}
+	if err := ensureMountOpts(ctx, tgtPath, opts...); err != nil {
+		gofsutil.Unmount(ctx, tgtPath)
+		os.RemoveAll(dir)
+		return nil, status.Errorf(codes.Internal,
+			"target mount verification failed: %s: %v", tgtPath, err)
+	}
+
+	log.WithFields(map[string]interface{}{
+		"volume":  volumeID,
+		"target":  tgtPath,
+		"scratch": dir,
+	}).Info("published overlay target")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// mkdirLike creates the directory with the owner and mode of another
+// directory.
+func mkdirLike(dir, like string) error {
+	fi, err := os.Stat(like)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Chown(dir, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(dir, fi.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+}
+
+// checkOverlay returns an error if the volume may not be published to
+// an overlay target.
+func checkOverlay(volumeID string, encrypted bool, idMap *idMapping) error {
+	if runtime.GOOS != "linux" {
+		return status.Errorf(codes.FailedPrecondition,
+			"overlay targets unsupported: %s", runtime.GOOS)
+	}
+	if encrypted {
+		// The scratch layer is not encrypted.
+		return status.Errorf(codes.InvalidArgument,
+			"overlay targets of encrypted volumes unsupported: %s", volumeID)
+	}
+	if idMap != nil {
+		return status.Errorf(codes.InvalidArgument,
+			"ID-mapped overlay targets unsupported: %s", volumeID)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramUID is the CreateVolume parameter that specifies the user ID
+	// of the owner of the volume's root directory.
+	paramUID = "uid"
+
+	// paramGID is the CreateVolume parameter that specifies the group ID
+	// of the owner of the volume's root directory.
+	paramGID = "gid"
+
+	// paramMode is the CreateVolume parameter that specifies the octal
+	// permissions of the volume's root directory.
+	paramMode = "mode"
+
+	// attribFSGroup is the volume attribute that specifies the group ID
+	// that NodePublishVolume applies to all of the volume's files.
+	attribFSGroup = "fsGroup"
+)
+
+// volumeOwnership is the ownership and permissions of a volume's root
+// directory. A negative ID or mode is not applied.
+type volumeOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+// getVolumeOwnership returns the ownership and permissions of a volume's
+// root directory from the CreateVolume parameters. A nil value is
+// returned if none of the parameters are specified.
+func getVolumeOwnership(params map[string]string) (*volumeOwnership, error) {
+	o := &volumeOwnership{uid: -1, gid: -1, mode: 0}
+	ok := false
+
+	if v, exists := params[paramUID]; exists {
+		id, err := parseID(paramUID, v)
+		if err != nil {
+			return nil, err
+		}
+		o.uid, ok = id, true
+	}
+	if v, exists := params[paramGID]; exists {
+		id, err := parseID(paramGID, v)
+		if err != nil {
+			return nil, err
+		}
+		o.gid, ok = id, true
+	}
+	if v, exists := params[paramMode]; exists {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 07777 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s=%s", paramMode, v)
+		}
+		o.mode, ok = toFileMode(uint32(m)), true
+	}
+
+	if !ok {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// parseID parses a non-negative user or group ID.
+func parseID(key, val string) (int, error) {
+	id, err := strconv.Atoi(val)
+	if err != nil || id < 0 {
+		return -1, status.Errorf(codes.InvalidArgument,
+			"invalid param: %s=%s", key, val)
+	}
+	return id, nil
+}
+
+// toFileMode converts Unix permission bits, including the setuid,
+// setgid, and sticky bits, to an os.FileMode.
+func toFileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// apply applies the ownership and permissions to the directory.
+func (o *volumeOwnership) apply(dir string) error {
+	if o.uid >= 0 || o.gid >= 0 {
+		if err := os.Chown(dir, o.uid, o.gid); err != nil {
+			return status.Errorf(codes.Internal,
+				"chown failed: %s: %v", dir, err)
+		}
+	}
+	if o.mode != 0 {
+		if err := os.Chmod(dir, o.mode); err != nil {
+			return status.Errorf(codes.Internal,
+				"chmod failed: %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// getFSGroup returns the group ID from the volume attributes. A negative
+// value is returned if the attribute is not specified.
+func getFSGroup(attribs map[string]string) (int, error) {
+	v, ok := attribs[attribFSGroup]
+	if !ok || v == "" {
+		return -1, nil
+	}
+	return parseID(attribFSGroup, v)
+}
+
+// applyFSGroup recursively changes the group of the files in the
+// directory to the group ID and sets the setgid bit on the directories
+// so that new files inherit the group. Symlinks are changed but not
+// followed.
+func applyFSGroup(dir string, gid int) error {
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(p, -1, gid); err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Mode()&os.ModeSetgid == 0 {
+			return os.Chmod(p, fi.Mode()|os.ModeSetgid)
+		}
+		return nil
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to apply fsGroup: %s: %d: %v", dir, gid, err)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// paramProjected is the CreateVolume parameter that indicates the
+	// volume is a projected volume. NodePublishVolume mounts a tmpfs to
+	// the target of a projected volume and writes the volume's projected
+	// files to it instead of bind mounting the volume's directory.
+	paramProjected = "projected"
+
+	// paramProjectedFiles is the CreateVolume parameter, and therefore
+	// the volume attribute, that contains the JSON map of the paths of a
+	// projected volume's files to their sources and modes.
+	paramProjectedFiles = "projectedFiles"
+
+	// projectedFileMode is the default mode of a projected file.
+	projectedFileMode = 0644
+
+	// projectedSourcePrefix is the prefix of the source of the tmpfs
+	// mounts of projected volumes.
+	projectedSourcePrefix = "csi-vfs-projected:"
+)
+
+// projectedFile is the source and mode of a projected volume's file. The
+// file's contents are either the data or the NodePublishVolume
+// credential with the secret's name.
+type projectedFile struct {
+	Data   *string `json:"data,omitempty"`
+	Secret string  `json:"secret,omitempty"`
+	Mode   string  `json:"mode,omitempty"`
+
+	path string
+	mode os.FileMode
+}
+
+// isProjected returns a flag that indicates whether the CreateVolume
+// parameters request a projected volume.
+func isProjected(params map[string]string) (bool, error) {
+	v, ok := params[paramProjected]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"invalid param: %s=%s", paramProjected, v)
+	}
+	return b, nil
+}
+
+// getProjectedFiles returns the files of a projected volume from the
+// volume's attributes, sorted by path.
+func getProjectedFiles(attribs map[string]string) ([]*projectedFile, error) {
+	v, ok := attribs[paramProjectedFiles]
+	if !ok {
+		return nil, nil
+	}
+	var m map[string]*projectedFile
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid param: %s: %v", paramProjectedFiles, err)
+	}
+
+	files := make([]*projectedFile, 0, len(m))
+	for p, f := range m {
+		if err := f.validate(p); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s: %s: %v", paramProjectedFiles, p, err)
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+
+	// A file's path may not be the directory of another file.
+	for _, f := range files {
+		for d := path.Dir(f.path); d != "."; d = path.Dir(d) {
+			if _, ok := m[d]; ok {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"invalid param: %s: %s: path is the directory of %s",
+					paramProjectedFiles, d, f.path)
+			}
+		}
+	}
+	return files, nil
+}
+
+// validate validates the file's source and mode and sets its clean path.
+func (f *projectedFile) validate(p string) error {
+	if f == nil {
+		return fmt.Errorf("missing source")
+	}
+	if p == "" || path.IsAbs(p) {
+		return fmt.Errorf("path must be relative")
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("path must be clean and may not contain ..")
+		}
+	}
+	f.path = p
+
+	if (f.Data == nil) == (f.Secret == "") {
+		return fmt.Errorf("exactly one of data and secret required")
+	}
+
+	f.mode = projectedFileMode
+	if f.Mode != "" {
+		m, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			return fmt.Errorf("invalid mode: %s", f.Mode)
+		}
+		f.mode = os.FileMode(m)
+	}
+	return nil
+}
+
+// getProjectedSource returns the source of the tmpfs mounts of a
+// projected volume, which identifies the mounts in the mount table.
+func getProjectedSource(volumeID string) string {
+	return projectedSourcePrefix + volumeID
+}
+
+// publishProjected mounts a tmpfs to the target of a projected volume
+// and writes the volume's projected files to it. The tmpfs is limited to
+// the volume's capacity when the volume has one. The options of the
+// target's mount are applied after the files are written.
+func (s *service) publishProjected(
+	ctx context.Context,
+	req *csi.NodePublishVolumeRequest,
+	vol *volumeInfo,
+	tgtPath string,
+	opts []string,
+	fsGroup int) (*csi.NodePublishVolumeResponse, error) {
+
+	if runtime.GOOS != "linux" {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"projected volumes unsupported: %s", runtime.GOOS)
+	}
+
+	// Get the contents of the files before the target is mounted so a
+	// missing secret does not leave an empty mount behind.
+	files, err := getProjectedFiles(req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, len(files))
+	var size int64
+	for i, f := range files {
+		if f.Data != nil {
+			data[i] = []byte(*f.Data)
+		} else if v, ok := req.NodePublishCredentials[f.Secret]; ok {
+			data[i] = []byte(v)
+		} else {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"projected file requires credential: %s: %s",
+				f.path, f.Secret)
+		}
+		size += int64(len(data[i]))
+	}
+	if vol.capacityBytes > 0 && size > vol.capacityBytes {
+		return nil, status.Errorf(codes.OutOfRange,
+			"projected files exceed volume capacity: %d", size)
+	}
+
+	// An existing mount of the target is only verified, so the files of
+	// a published target do not change.
+	mounted, err := s.getProjectedMounts(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if mounted[tgtPath] {
+		if err := ensureMountOpts(ctx, tgtPath, opts...); err != nil {
+			gofsutil.Unmount(ctx, tgtPath)
+			return nil, status.Errorf(codes.Internal,
+				"target mount verification failed: %s: %v", tgtPath, err)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	mntOpts := []string{"mode=0755"}
+	if vol.capacityBytes > 0 {
+		mntOpts = append(mntOpts, fmt.Sprintf("size=%d", vol.capacityBytes))
+	}
+	if err := gofsutil.Mount(ctx, getProjectedSource(req.VolumeId),
+		tgtPath, "tmpfs", mntOpts...); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"tmpfs mount failed: %s: %v", tgtPath, err)
+	}
+
+	err = writeProjectedFiles(tgtPath, files, data)
+	if err == nil && fsGroup >= 0 {
+		err = applyFSGroup(tgtPath, fsGroup)
+	}
+	if err == nil {
+		err = ensureMountOpts(ctx, tgtPath, opts...)
+	}
+	if err != nil {
+		gofsutil.Unmount(ctx, tgtPath)
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to publish projected files: %s: %v", tgtPath, err)
+	}
+
+	log.WithFields(map[string]interface{}{
+		"volume": req.VolumeId,
+		"target": tgtPath,
+		"files":  len(files),
+	}).Info("published projected volume")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// writeProjectedFiles writes the files with their data to the empty
+// directory.
+func writeProjectedFiles(
+	dir string, files []*projectedFile, data [][]byte) error {
+
+	for i, f := range files {
+		p := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		w, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data[i]); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(p, f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpublishProjected unmounts the tmpfs mounted to the target of a
+// projected volume, which discards the target's files.
+func (s *service) unpublishProjected(
+	ctx context.Context, volumeID, tgtPath string) error {
+
+	mounted, err := s.getProjectedMounts(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	if !mounted[tgtPath] {
+		return nil
+	}
+	if err := gofsutil.Unmount(ctx, tgtPath); err != nil {
+		return status.Errorf(
+			codes.Internal, "unmount failed: %s: %v", tgtPath, err)
+	}
+	return nil
+}
+
+// resizeProjected remounts the tmpfs of each of the projected volume's
+// targets on this host with the new size. If a target cannot be resized
+// then the targets that were resized are restored to the old size and a
+// FailedPrecondition error that explains why is returned. The resized
+// targets are returned.
+func (s *service) resizeProjected(
+	ctx context.Context,
+	volumeID string,
+	oldBytes, newBytes int64) ([]string, error) {
+
+	mounted, err := s.getProjectedMounts(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	var resized []string
+	for tgtPath := range mounted {
+		if err := remountProjected(ctx, tgtPath, newBytes); err != nil {
+			for _, p := range resized {
+				remountProjected(ctx, p, oldBytes)
+			}
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"failed to resize projected volume target: %s: %s: %v",
+				volumeID, tgtPath, err)
+		}
+		resized = append(resized, tgtPath)
+	}
+	return resized, nil
+}
+
+// remountProjected remounts the tmpfs of a projected volume's target
+// with the size. A size of zero is the tmpfs default size.
+func remountProjected(ctx context.Context, tgtPath string, size int64) error {
+	opt := fmt.Sprintf("remount,size=%d", size)
+	if size == 0 {
+		opt = "remount,size=50%"
+	}
+	args := []string{"-o", opt, tgtPath}
+	f := log.Fields{"cmd": "mount", "args": strings.Join(args, " ")}
+	log.WithFields(f).Info("mount command")
+	if buf, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("remount failed: %v\noutput: %s", err, buf)
+	}
+	return nil
+}
+
+// getProjectedMounts returns the set of targets to which the tmpfs of
+// a projected volume is mounted.
+func (s *service) getProjectedMounts(
+	ctx context.Context, volumeID string) (map[string]bool, error) {
+
+	minfo, err := getMounts(ctx)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal, "failed to get mount info: %v", err)
+	}
+	src := getProjectedSource(volumeID)
+	targets := map[string]bool{}
+	for _, i := range minfo {
+		if i.Type == "tmpfs" && i.Device == src {
+			targets[i.Path] = true
+		}
+	}
+	return targets, nil
+}
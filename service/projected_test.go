@@ -0,0 +1,181 @@
+package service
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestGetProjectedFiles(t *testing.T) {
+	data := func(s string) *string { return &s }
+
+	type file struct {
+		path   string
+		data   *string
+		secret string
+		mode   os.FileMode
+	}
+	tests := []struct {
+		desc  string
+		files *string
+		want  []file
+		code  codes.Code
+	}{
+		{
+			desc: "no files",
+		},
+		{
+			desc:  "empty files",
+			files: data(`{}`),
+			want:  []file{},
+		},
+		{
+			desc: "data and secret files sorted by path",
+			files: data(`{
+				"config/app.yaml": {"data": "a: 1"},
+				"token": {"secret": "tok", "mode": "0400"},
+				"config/empty": {"data": ""},
+				"bin/run": {"data": "#!/bin/sh", "mode": "755"}
+			}`),
+			want: []file{
+				{path: "bin/run", data: data("#!/bin/sh"), mode: 0755},
+				{path: "config/app.yaml", data: data("a: 1"), mode: 0644},
+				{path: "config/empty", data: data(""), mode: 0644},
+				{path: "token", secret: "tok", mode: 0400},
+			},
+		},
+		{
+			desc: "sibling paths sharing a prefix",
+			files: data(`{
+				"a": {"data": "1"},
+				"ab": {"data": "2"},
+				"a-b/c": {"data": "3"}
+			}`),
+			want: []file{
+				{path: "a", data: data("1"), mode: 0644},
+				{path: "a-b/c", data: data("3"), mode: 0644},
+				{path: "ab", data: data("2"), mode: 0644},
+			},
+		},
+		{
+			desc:  "invalid JSON",
+			files: data(`{"a": `),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "invalid file",
+			files: data(`{"a": "data"}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "missing source",
+			files: data(`{"a": null}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "neither data nor secret",
+			files: data(`{"a": {"mode": "0600"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "data and secret",
+			files: data(`{"a": {"data": "1", "secret": "tok"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "empty path",
+			files: data(`{"": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "absolute path",
+			files: data(`{"/etc/passwd": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "parent traversal",
+			files: data(`{"../a": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "nested parent traversal",
+			files: data(`{"a/../../b": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "dot element",
+			files: data(`{"./a": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "empty element",
+			files: data(`{"a//b": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "trailing slash",
+			files: data(`{"a/": {"data": "1"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "invalid mode",
+			files: data(`{"a": {"data": "1", "mode": "rw"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "mode that is not octal",
+			files: data(`{"a": {"data": "1", "mode": "0999"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "mode with special bits",
+			files: data(`{"a": {"data": "1", "mode": "4755"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "path is the directory of another file",
+			files: data(`{"a": {"data": "1"}, "a/b": {"data": "2"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc:  "path is an ancestor directory of another file",
+			files: data(`{"a": {"data": "1"}, "a/b/c": {"data": "2"}}`),
+			code:  codes.InvalidArgument,
+		},
+		{
+			desc: "path is the directory of a file not sorted next to it",
+			files: data(`{
+				"a": {"data": "1"},
+				"a-b": {"data": "2"},
+				"a/b": {"data": "3"}
+			}`),
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		attribs := map[string]string{}
+		if tt.files != nil {
+			attribs[paramProjectedFiles] = *tt.files
+		}
+		files, err := getProjectedFiles(attribs)
+		if code := errorCode(err); code != tt.code {
+			t.Errorf("%s: code %v, want %v: %v", tt.desc, code, tt.code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []file
+		if files != nil {
+			got = []file{}
+		}
+		for _, f := range files {
+			got = append(got, file{f.path, f.Data, f.Secret, f.mode})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
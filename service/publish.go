@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// publishInfoPath is the key of the ControllerPublishVolume
+	// response's PublishInfo field that contains the path of the
+	// volume's device.
+	publishInfoPath = "path"
+
+	// publishInfoNodeID is the key of the ControllerPublishVolume
+	// response's PublishInfo field that contains the ID of the node
+	// to which the volume is attached. A controller that serves only
+	// the controller service returns this key instead of the path of
+	// the volume's device.
+	publishInfoNodeID = "nodeId"
+)
+
+// nodePublishInfo is the record persisted by NodePublishVolume when
+// a volume's device is mounted to the node's private mount directory.
+type nodePublishInfo struct {
+	VolumeID string `json:"volume_id"`
+	DevPath  string `json:"dev_path"`
+
+	// NodeDevice indicates the node service mounted the volume's device
+	// and is responsible for unmounting it.
+	NodeDevice bool `json:"node_device,omitempty"`
+
+	// KeyID is the identifier of the encryption key NodePublishVolume
+	// added for an encrypted volume.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// getNodePublishInfoPath returns the path of the record persisted by
+// NodePublishVolume for the specified volume.
+func (s *service) getNodePublishInfoPath(volumeID string) string {
+	return path.Join(s.publish, volumeID+".json")
+}
+
+// getNodePublishInfo returns the record persisted by NodePublishVolume
+// for the specified volume. A nil value is returned if no record exists.
+func (s *service) getNodePublishInfo(
+	volumeID string) (*nodePublishInfo, error) {
+
+	infoPath := s.getNodePublishInfoPath(volumeID)
+	f, err := os.Open(infoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to open publish info file: %s: %v", infoPath, err)
+	}
+	defer f.Close()
+	info := &nodePublishInfo{}
+	if err := json.NewDecoder(f).Decode(info); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal publish info: %s: %v", infoPath, err)
+	}
+	return info, nil
+}
+
+// saveNodePublishInfo persists the record for a volume published to
+// the node.
+func (s *service) saveNodePublishInfo(info *nodePublishInfo) error {
+	infoPath := s.getNodePublishInfoPath(info.VolumeID)
+	f, err := os.Create(infoPath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to create publish info file: %s: %v", infoPath, err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+// removeNodePublishInfo removes the record for a volume that is no
+// longer published to the node.
+func (s *service) removeNodePublishInfo(volumeID string) error {
+	infoPath := s.getNodePublishInfoPath(volumeID)
+	if err := os.Remove(infoPath); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal,
+			"failed to remove publish info file: %s: %v", infoPath, err)
+	}
+	return nil
+}
+
+// getPublishedDevPath returns the path of the volume's device. The path
+// returned by ControllerPublishVolume is used if the request includes
+// it, otherwise the path is derived from the node's device directory.
+//
+// A published path is rejected if it is not absolute, does not name
+// the requested volume, or is a mount of a different volume.
+func (s *service) getPublishedDevPath(
+	ctx context.Context,
+	req *csi.NodePublishVolumeRequest,
+	vol *volumeInfo) (string, error) {
+
+	// If the volume was attached by a controller that serves only the
+	// controller service then ensure it was attached to this node.
+	if nodeID, ok := req.PublishInfo[publishInfoNodeID]; ok &&
+		nodeID != s.nodeID {
+		return "", status.Errorf(codes.FailedPrecondition,
+			"publish info mismatch: node=%s, published node=%s",
+			s.nodeID, nodeID)
+	}
+
+	devPath, ok := req.PublishInfo[publishInfoPath]
+	if !ok || devPath == "" {
+		return path.Join(s.dev, req.VolumeId), nil
+	}
+
+	if !path.IsAbs(devPath) {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid publish info: path not absolute: %s", devPath)
+	}
+	devPath = path.Clean(devPath)
+	if path.Base(devPath) != req.VolumeId {
+		return "", status.Errorf(codes.InvalidArgument,
+			"publish info mismatch: path=%s, volume=%s",
+			devPath, req.VolumeId)
+	}
+
+	// If the published path does not exist then the volume has not
+	// been published to this node.
+	if ok, err := fileExists(devPath); !ok {
+		if err != nil {
+			return "", status.Errorf(codes.NotFound, "%s: %v", devPath, err)
+		}
+		return "", status.Errorf(codes.Aborted,
+			"must call ControllerPublishVolume first: %s", devPath)
+	}
+	if err := gofsutil.EvalSymlinks(ctx, &devPath); err != nil {
+		return "", status.Errorf(codes.Internal,
+			"failed to eval symlink: %s: %v", devPath, err)
+	}
+
+	// If the published path is a mount point then ensure it is a mount
+	// of the requested volume.
+	minfo, err := getMounts(ctx)
+	if err != nil {
+		return "", status.Errorf(
+			codes.Internal, "failed to get mount info: %v", err)
+	}
+	for _, i := range minfo {
+		if i.Path == devPath && i.Source != vol.path {
+			return "", status.Errorf(codes.FailedPrecondition,
+				"publish info mismatch: path=%s, source=%s, volume=%s",
+				devPath, i.Source, vol.path)
+		}
+	}
+
+	return devPath, nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramSealable is the CreateVolume parameter that indicates the
+	// volume may be sealed.
+	paramSealable = "sealable"
+
+	// paramRetention is the CreateVolume parameter that specifies how
+	// long DeleteVolume refuses to delete a volume after it is sealed.
+	paramRetention = "retention"
+)
+
+// sealPolicy is the sealing policy of a volume.
+type sealPolicy struct {
+	sealable  bool
+	retention time.Duration
+}
+
+// getSealPolicy returns the sealing policy of a volume from the
+// CreateVolume parameters.
+func getSealPolicy(params map[string]string) (sealPolicy, error) {
+	var p sealPolicy
+	if v, ok := params[paramSealable]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s=%s", paramSealable, v)
+		}
+		p.sealable = b
+	}
+	if v, ok := params[paramRetention]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return p, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s=%s", paramRetention, v)
+		}
+		if !p.sealable {
+			return p, status.Errorf(codes.InvalidArgument,
+				"invalid param: %s requires %s=true",
+				paramRetention, paramSealable)
+		}
+		p.retention = d
+	}
+	return p, nil
+}
+
+// SealVolume records the time the volume is sealed and sets the
+// immutable flag of the volume's files. If the volume's filesystem does
+// not support the flag then the volume is protected only by publishing
+// it read-only. Sealing a sealed volume sets the immutable flag again.
+func (s *service) SealVolume(ctx context.Context, id string) error {
+	unlock, err := s.lockVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	vol, err := s.getVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkNotCloning(vol); err != nil {
+		return err
+	}
+	p, err := getSealPolicy(vol.Parameters)
+	if err != nil {
+		return err
+	}
+	if !p.sealable {
+		return status.Errorf(codes.FailedPrecondition,
+			"volume not sealable: %s", id)
+	}
+
+	// Record the seal before the volume's files, which may include its
+	// info file, become immutable.
+	if vol.sealed.IsZero() {
+		vol.sealed = time.Now().UTC()
+		if err := s.store.saveVolume(ctx, vol); err != nil {
+			return err
+		}
+	}
+
+	fields := map[string]interface{}{
+		"volume":    id,
+		"sealed":    vol.sealed,
+		"retention": p.retention,
+	}
+	ok, err := setImmutable(vol.path, true)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to set immutable flag: %s: %v", vol.path, err)
+	}
+	if !ok {
+		log.WithFields(fields).Warn(
+			"immutable flag unsupported: sealed volume is only published ro")
+		return nil
+	}
+	log.WithFields(fields).Info("sealed volume")
+	return nil
+}
+
+// unsealForDelete returns a FailedPrecondition error if the sealed
+// volume's retention period has not passed. Otherwise the immutable flag
+// of the volume's files is cleared so the volume may be removed.
+func unsealForDelete(vol *volumeInfo) error {
+	if vol.sealed.IsZero() {
+		return nil
+	}
+	p, err := getSealPolicy(vol.Parameters)
+	if err != nil {
+		return err
+	}
+	if until := vol.sealed.Add(p.retention); time.Now().Before(until) {
+		return status.Errorf(codes.FailedPrecondition,
+			"volume sealed until %s", until.Format(time.RFC3339))
+	}
+	if _, err := setImmutable(vol.path, false); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to clear immutable flag: %s: %v", vol.path, err)
+	}
+	return nil
+}
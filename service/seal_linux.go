@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// The inode flags ioctls and the immutable inode flag.
+const (
+	fsIocGetFlags   = 0x80006601 | unsafe.Sizeof(uintptr(0))<<16
+	fsIocSetFlags   = 0x40006602 | unsafe.Sizeof(uintptr(0))<<16
+	fsImmutableFlag = 0x00000010
+)
+
+// setImmutable sets or clears the immutable flag of the directory and
+// the regular files and directories beneath it. A false value is returned
+// if the directory's filesystem does not support the flag.
+func setImmutable(dir string, immutable bool) (bool, error) {
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+		return setImmutableFlag(p, immutable)
+	})
+	switch err {
+	case syscall.ENOTTY, syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setImmutableFlag sets or clears the immutable flag of a file.
+func setImmutableFlag(p string, immutable bool) error {
+	f, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var flags int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return errno
+	}
+	set := flags | fsImmutableFlag
+	if !immutable {
+		set = flags &^ fsImmutableFlag
+	}
+	if set == flags {
+		return nil
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&set))); errno != 0 {
+		return errno
+	}
+	return nil
+}
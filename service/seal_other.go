@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+// setImmutable returns a false value since the immutable flag is only
+// set on Linux. Sealed volumes are protected by publishing them
+// read-only.
+func setImmutable(dir string, immutable bool) (bool, error) {
+	return false, nil
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/akutz/gofsutil"
+	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/golang/protobuf/jsonpb"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
@@ -33,6 +38,17 @@ const (
 	SupportedVersions = "0.2.0"
 
 	infoFileName = ".info.json"
+
+	// modeController indicates the process serves only the controller
+	// service. ControllerPublishVolume and ControllerUnpublishVolume
+	// only keep records of attachments and the node service is
+	// responsible for mounting the volume's device.
+	modeController = "controller"
+
+	// modeNode indicates the process serves only the node service.
+	// NodePublishVolume mounts the volume's device if it is not
+	// published by the controller.
+	modeNode = "node"
 )
 
 // Service is a CSI SP and gocsi.IdempotencyProvider.
@@ -44,12 +60,32 @@ type Service interface {
 }
 
 type service struct {
-	bindfs  string
-	data    string
-	dev     string
-	mnt     string
-	vol     string
-	volGlob string
+	mode              string
+	bindfs            string
+	zstd              string
+	gitPath           string
+	contentRoot       string
+	data              string
+	dev               string
+	mnt               string
+	vol               string
+	snap              string
+	publish           string
+	volGlob           string
+	nodes             string
+	nodeID            string
+	nodeTopology      map[string]string
+	nodeMaxVolumes    int
+	maxVolumesPerNode int
+	store             volumeStore
+	etcd              *etcd.Client
+	etcdPrefix        string
+	leader            leaderElector
+	dataLock          *os.File
+	mountFlags        map[string]bool
+	attL              sync.Mutex
+	clones            map[string]*cloneCopy
+	cloneL            sync.Mutex
 }
 
 // New returns a new Service.
@@ -62,15 +98,174 @@ func (s *service) BeforeServe(
 
 	defer func() {
 		log.WithFields(map[string]interface{}{
-			"bindfs":  s.bindfs,
-			"data":    s.data,
-			"dev":     s.dev,
-			"mnt":     s.mnt,
-			"vol":     s.vol,
-			"volGlob": s.volGlob,
+			"mode":     s.mode,
+			"bindfs":   s.bindfs,
+			"data":     s.data,
+			"dev":      s.dev,
+			"mnt":      s.mnt,
+			"vol":      s.vol,
+			"snap":     s.snap,
+			"volGlob":  s.volGlob,
+			"nodes":    s.nodes,
+			"nodeID":   s.nodeID,
+			"nodeTopo": s.nodeTopology,
+			"nodeMax":  s.nodeMaxVolumes,
+			"maxVols":  s.maxVolumesPerNode,
 		}).Infof("configured %s", Name)
 	}()
 
+	// Determine whether this process serves only the controller or
+	// node service. The services may be split across processes that
+	// share the volume directory.
+	if v := csictx.Getenv(ctx, gocsi.EnvVarMode); strings.EqualFold(
+		v, modeController) {
+		s.mode = modeController
+	} else if strings.EqualFold(v, modeNode) {
+		s.mode = modeNode
+	}
+
+	if err := s.configure(ctx); err != nil {
+		return err
+	}
+
+	// Take ownership of the data directory so that another process
+	// configured with a different layout does not use it at the same
+	// time, unless the directory is deliberately shared.
+	shared := s.getEnvBool(ctx, EnvVarDataShared)
+	if err := checkDataShared(ctx, shared); err != nil {
+		return err
+	}
+	if err := s.lockDataDir(ctx, shared); err != nil {
+		return err
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarBindFS); ok {
+		s.bindfs = v
+	}
+	if s.bindfs == "" {
+		s.bindfs = "bindfs"
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarZstd); ok {
+		s.zstd = v
+	}
+	if s.zstd == "" {
+		s.zstd = "zstd"
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarNodesDir); ok {
+		s.nodes = v
+	}
+	if s.nodes == "" {
+		s.nodes = path.Join(s.data, "nodes")
+	}
+	if err := os.MkdirAll(s.nodes, 0755); err != nil {
+		return err
+	}
+	if err := gofsutil.EvalSymlinks(ctx, &s.nodes); err != nil {
+		return err
+	}
+
+	if err := s.configureNodeID(ctx); err != nil {
+		return err
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarNodeTopology); ok {
+		m, err := parseTopology(v)
+		if err != nil {
+			return err
+		}
+		s.nodeTopology = m
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarNodeMaxVolumes); ok && v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		s.nodeMaxVolumes = i
+	}
+
+	if v, ok := csictx.LookupEnv(
+		ctx, EnvVarMaxVolumesPerNode); ok && v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		s.maxVolumesPerNode = i
+	}
+
+	mntFlags := defaultMountFlags
+	if v, ok := csictx.LookupEnv(ctx, EnvVarMountFlags); ok {
+		mntFlags = v
+	}
+	mf, err := parseMountFlags(
+		mntFlags, csictx.Getenv(ctx, EnvVarMountFlagsDeny))
+	if err != nil {
+		return err
+	}
+	s.mountFlags = mf
+
+	// Record the node's ID, topology, and volume limit so the controller
+	// service is able to validate ControllerPublishVolume requests. A
+	// process that serves only the controller service is not a node.
+	if s.mode != modeController {
+		if err := s.saveNode(); err != nil {
+			return err
+		}
+	}
+
+	// Serialize access to volumes across the processes that share the
+	// data directory. GoCSI's own serial volume interceptor only
+	// serializes access within this process.
+	if s.hasFileLocks(ctx) {
+		if err := s.initFileLocks(ctx, sp); err != nil {
+			return err
+		}
+	}
+
+	// Elect the leader of the controllers. A process that serves only
+	// the node service does not participate in the election.
+	if s.mode != modeNode {
+		if err := s.initLeaderElection(ctx); err != nil {
+			return err
+		}
+	}
+	if s.leader != nil {
+		sp.Interceptors = append(sp.Interceptors, s.requireLeader)
+	}
+
+	// Add an interceptor that validates all requests that include
+	// one or more volume capabilities:
+	//
+	// * CreateVolume
+	// * ControllerPublishVolume
+	// * ValidateVolumeCapabilities
+	// * NodePublishVolume
+	sp.Interceptors = append(sp.Interceptors, s.validateVolumeCapabilities)
+
+	return nil
+}
+
+// configureNodeID sets the node's ID from the environment, or from the
+// host name if it is not specified.
+func (s *service) configureNodeID(ctx context.Context) error {
+	if v, ok := csictx.LookupEnv(ctx, EnvVarNodeID); ok {
+		s.nodeID = v
+	}
+	if s.nodeID == "" {
+		v, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		s.nodeID = v
+	}
+	return validateNodeID(s.nodeID)
+}
+
+// configure configures the SP's directories and volume store from the
+// environment.
+func (s *service) configure(ctx context.Context) error {
 	if v, ok := csictx.LookupEnv(ctx, EnvVarDataDir); ok {
 		s.data = v
 	}
@@ -128,6 +323,27 @@ func (s *service) BeforeServe(
 		return err
 	}
 
+	if v, ok := csictx.LookupEnv(ctx, EnvVarSnapDir); ok {
+		s.snap = v
+	}
+	if s.snap == "" {
+		s.snap = path.Join(s.data, "snap")
+	}
+	if err := os.MkdirAll(s.snap, 0755); err != nil {
+		return err
+	}
+	if err := gofsutil.EvalSymlinks(ctx, &s.snap); err != nil {
+		return err
+	}
+
+	// NodePublishVolume records the volumes published to the node in a
+	// directory of their own so that a record's name may not clash with
+	// a volume's private mount.
+	s.publish = path.Join(s.data, "publish")
+	if err := os.MkdirAll(s.publish, 0755); err != nil {
+		return err
+	}
+
 	if v, ok := csictx.LookupEnv(ctx, EnvVarVolGlob); ok {
 		s.vol = v
 	}
@@ -136,37 +352,105 @@ func (s *service) BeforeServe(
 	}
 	s.volGlob = path.Join(s.vol, s.volGlob, infoFileName)
 
-	if v, ok := csictx.LookupEnv(ctx, EnvVarBindFS); ok {
-		s.bindfs = v
+	if v, ok := csictx.LookupEnv(ctx, EnvVarGit); ok {
+		s.gitPath = v
 	}
-	if s.bindfs == "" {
-		s.bindfs = "bindfs"
+	if s.gitPath == "" {
+		s.gitPath = "git"
 	}
 
-	// Add an interceptor that validates all requests that include
-	// one or more volume capabilities:
-	//
-	// * CreateVolume
-	// * ControllerPublishVolume
-	// * ValidateVolumeCapabilities
-	// * NodePublishVolume
-	sp.Interceptors = append(sp.Interceptors, s.validateVolumeCapabilities)
+	if v, ok := csictx.LookupEnv(ctx, EnvVarContentRoot); ok && v != "" {
+		if !path.IsAbs(v) {
+			return fmt.Errorf("content root must be absolute: %s", v)
+		}
+		if err := gofsutil.EvalSymlinks(ctx, &v); err != nil {
+			return err
+		}
+		s.contentRoot = v
+	}
+
+	// Initialize the store that persists the metadata of volumes
+	// and their attachments.
+	switch v := csictx.Getenv(ctx, EnvVarStore); strings.ToLower(v) {
+	case "", storeFile:
+		att := path.Join(s.data, "att")
+		if err := os.MkdirAll(att, 0755); err != nil {
+			return err
+		}
+		snapInfo := path.Join(s.data, "snapinfo")
+		if err := os.MkdirAll(snapInfo, 0755); err != nil {
+			return err
+		}
+		volInfo := path.Join(s.data, "volinfo")
+		if err := os.MkdirAll(volInfo, 0755); err != nil {
+			return err
+		}
+		s.store = &fileStore{
+			vol:      s.vol,
+			volGlob:  s.volGlob,
+			volInfo:  volInfo,
+			att:      att,
+			snapInfo: snapInfo,
+		}
+	case storeEtcd:
+		client, prefix, err := s.getEtcdClient(ctx)
+		if err != nil {
+			return err
+		}
+		timeout, err := getEtcdRequestTimeout(ctx)
+		if err != nil {
+			return err
+		}
+		s.store = &etcdStore{
+			client:  client,
+			prefix:  prefix,
+			vol:     s.vol,
+			timeout: timeout,
+		}
+	default:
+		return fmt.Errorf("invalid volume store: %s", v)
+	}
 
 	return nil
 }
 
+// getEnvBool returns the boolean value of the environment variable.
+// False is returned if the variable is not set or not a valid boolean.
+func (s *service) getEnvBool(ctx context.Context, key string) bool {
+	v, ok := csictx.LookupEnv(ctx, key)
+	if !ok {
+		return false
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return false
+}
+
 type volumeInfo struct {
 	csi.CreateVolumeRequest
-	capacityBytes int64
-	path          string
-	infoPath      string
+	capacityBytes      int64
+	accessibleTopology map[string]string
+	sealed             time.Time
+	gitCommit          string
+	clone              *cloneInfo
+	path               string
+	infoPath           string
 }
 
 func (v *volumeInfo) toCSIVolInfo() *csi.Volume {
+	attrs := v.Parameters
+	if v.gitCommit != "" {
+		attrs = make(map[string]string, len(v.Parameters)+1)
+		for k, val := range v.Parameters {
+			attrs[k] = val
+		}
+		attrs[attribGitCommit] = v.gitCommit
+	}
 	return &csi.Volume{
 		Id:            v.Name,
 		CapacityBytes: v.capacityBytes,
-		Attributes:    v.Parameters,
+		Attributes:    attrs,
 	}
 }
 
@@ -177,19 +461,35 @@ func (v *volumeInfo) MarshalJSON() ([]byte, error) {
 		return nil, status.Errorf(codes.Internal,
 			"failed to marshal create request: %v", err)
 	}
+	var sealed *time.Time
+	if !v.sealed.IsZero() {
+		sealed = &v.sealed
+	}
 	return json.Marshal(struct {
-		CapacityBytes int64           `json:"capacity_bytes"`
-		CreateRequest json.RawMessage `json:"create_request"`
+		CapacityBytes      int64             `json:"capacity_bytes"`
+		AccessibleTopology map[string]string `json:"accessible_topology,omitempty"`
+		Sealed             *time.Time        `json:"sealed,omitempty"`
+		GitCommit          string            `json:"git_commit,omitempty"`
+		Clone              *cloneInfo        `json:"clone,omitempty"`
+		CreateRequest      json.RawMessage   `json:"create_request"`
 	}{
-		CapacityBytes: v.capacityBytes,
-		CreateRequest: buf.Bytes(),
+		CapacityBytes:      v.capacityBytes,
+		AccessibleTopology: v.accessibleTopology,
+		Sealed:             sealed,
+		GitCommit:          v.gitCommit,
+		Clone:              v.clone,
+		CreateRequest:      buf.Bytes(),
 	})
 }
 
 func (v *volumeInfo) UnmarshalJSON(data []byte) error {
 	obj := struct {
-		CapacityBytes int64           `json:"capacity_bytes"`
-		CreateRequest json.RawMessage `json:"create_request"`
+		CapacityBytes      int64             `json:"capacity_bytes"`
+		AccessibleTopology map[string]string `json:"accessible_topology"`
+		Sealed             *time.Time        `json:"sealed"`
+		GitCommit          string            `json:"git_commit"`
+		Clone              *cloneInfo        `json:"clone"`
+		CreateRequest      json.RawMessage   `json:"create_request"`
 	}{}
 	if err := json.Unmarshal(data, &obj); err != nil {
 		return status.Errorf(codes.Internal,
@@ -201,6 +501,12 @@ func (v *volumeInfo) UnmarshalJSON(data []byte) error {
 			"failed to unmarshal create request: %v", err)
 	}
 	v.capacityBytes = obj.CapacityBytes
+	v.accessibleTopology = obj.AccessibleTopology
+	if obj.Sealed != nil {
+		v.sealed = *obj.Sealed
+	}
+	v.gitCommit = obj.GitCommit
+	v.clone = obj.Clone
 	return nil
 }
 
@@ -235,36 +541,6 @@ func (v *volumeInfo) load() error {
 	return dec.Decode(&v)
 }
 
-func (s *service) getVolume(idOrName string) (*volumeInfo, error) {
-
-	// Get the path of the volume and ensure it exists.
-	volPath := path.Join(s.vol, idOrName)
-	if ok, err := fileExists(volPath); !ok {
-		if err != nil {
-			return nil, status.Errorf(codes.NotFound, "%s: %v", volPath, err)
-		}
-		return nil, status.Error(codes.NotFound, volPath)
-	}
-
-	// Get the path of the volume info file and ensure it exists.
-	volInfoPath := path.Join(volPath, infoFileName)
-	if ok, err := fileExists(volInfoPath); !ok {
-		if err != nil {
-			return nil, status.Errorf(codes.NotFound, "%s: %v", volInfoPath, err)
-		}
-		return nil, status.Error(codes.NotFound, volInfoPath)
-	}
-
-	// Create a new volumeInfo object and try to unmarshal its contents
-	// from disk.
-	vol := &volumeInfo{path: volPath, infoPath: volInfoPath}
-	if err := vol.load(); err != nil {
-		return nil, err
-	}
-
-	return vol, nil
-}
-
 // fileExists returns a flag indicating whether or not a file
 // path exists.
 func fileExists(filePath string) (bool, error) {
@@ -314,32 +590,60 @@ var getMountsObj = &gofsutil.FS{
 		validFSType, _ := regexp.MatchString(
 			`(?i)^devtmpfs|(?:fuse\..*)|(?:nfs\d?)|overlay$`, entry.FSType)
 		sourceHasSlashPrefix := strings.HasPrefix(entry.MountSource, "/")
-		if valid = validFSType || sourceHasSlashPrefix; !valid {
+		projectedTmpfs := entry.FSType == "tmpfs" &&
+			strings.HasPrefix(entry.MountSource, projectedSourcePrefix)
+		if valid = validFSType || sourceHasSlashPrefix || projectedTmpfs; !valid {
 			return
 		}
+		return getMountInfo(entry, cache), true, nil
+	},
+}
 
-		// Copy the Entry object's fields to the Info object.
-		info.Device = entry.MountSource
-		info.Opts = make([]string, len(entry.MountOpts))
-		copy(info.Opts, entry.MountOpts)
-		info.Path = entry.MountPoint
-		info.Type = entry.FSType
-		info.Source = entry.MountSource
-
-		// If this is the first time a source is encountered in the
-		// output then cache its mountPoint field as the filesystem path
-		// to which the source is mounted as a non-bind mount.
-		//
-		// Subsequent encounters with the source will resolve it
-		// to the cached root value in order to set the mount info's
-		// Source field to the the cached mountPont field value + the
-		// value of the current line's root field.
-		if cachedEntry, ok := cache[entry.MountSource]; ok {
-			info.Source = path.Join(cachedEntry.MountPoint, entry.Root)
-		} else {
-			cache[entry.MountSource] = entry
-		}
+// getAllMounts returns every entry in the mount table, regardless of its
+// source or file system type. Mount points that are looked up by path,
+// such as a target whose volume is on a tmpfs, may not be found in the
+// entries returned by getMounts.
+func getAllMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	return getAllMountsObj.GetMounts(ctx)
+}
+
+var getAllMountsObj = &gofsutil.FS{
+	ScanEntry: func(
+		ctx context.Context,
+		entry gofsutil.Entry,
+		cache map[string]gofsutil.Entry) (
+		info gofsutil.Info, valid bool, failed error) {
 
-		return
+		return getMountInfo(entry, cache), true, nil
 	},
 }
+
+// getMountInfo returns the mount info of a mount table entry.
+func getMountInfo(
+	entry gofsutil.Entry,
+	cache map[string]gofsutil.Entry) (info gofsutil.Info) {
+
+	// Copy the Entry object's fields to the Info object.
+	info.Device = entry.MountSource
+	info.Opts = make([]string, len(entry.MountOpts))
+	copy(info.Opts, entry.MountOpts)
+	info.Path = entry.MountPoint
+	info.Type = entry.FSType
+	info.Source = entry.MountSource
+
+	// If this is the first time a source is encountered in the
+	// output then cache its mountPoint field as the filesystem path
+	// to which the source is mounted as a non-bind mount.
+	//
+	// Subsequent encounters with the source will resolve it
+	// to the cached root value in order to set the mount info's
+	// Source field to the the cached mountPont field value + the
+	// value of the current line's root field.
+	if cachedEntry, ok := cache[entry.MountSource]; ok {
+		info.Source = path.Join(cachedEntry.MountPoint, entry.Root)
+	} else {
+		cache[entry.MountSource] = entry
+	}
+
+	return
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// paramSnapshot is the CreateVolume parameter that specifies the ID of
+// the snapshot whose contents are copied to a new volume.
+const paramSnapshot = "snapshot"
+
+// Snapshot is the record of a point-in-time copy of a volume. A snapshot
+// is not ready until its contents are completely copied.
+type Snapshot struct {
+	ID             string    `json:"id"`
+	SourceVolumeID string    `json:"source_volume_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	SizeBytes      int64     `json:"size_bytes"`
+	Ready          bool      `json:"ready"`
+}
+
+// validateSnapshotID returns an error if the snapshot ID cannot be used
+// as the name of a file in the snapshot directory.
+func validateSnapshotID(id string) error {
+	if id == "" || id == "." || id == ".." ||
+		strings.ContainsRune(id, '/') {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid snapshot id: %q", id)
+	}
+	return nil
+}
+
+// getSnapshotPath returns the path of the snapshot's contents.
+func (s *service) getSnapshotPath(id string) string {
+	return path.Join(s.snap, id)
+}
+
+// SnapshotVolume copies the contents of the volume to a new snapshot
+// with the specified name, which is also the snapshot's ID. Files are
+// copied one at a time, so a volume that is attached read-write may not
+// be snapshotted unless it is sealed. Creating a snapshot that exists
+// returns the snapshot, and creating a snapshot that is not ready copies
+// its contents again.
+func (s *service) SnapshotVolume(
+	ctx context.Context, volumeID, name string) (*Snapshot, error) {
+
+	if err := validateSnapshotID(name); err != nil {
+		return nil, err
+	}
+	unlockSnap, err := s.lockSnapshot(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockSnap()
+	unlockVol, err := s.lockVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
+
+	snap, err := s.store.getSnapshot(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil {
+		if snap.SourceVolumeID != volumeID {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"snapshot of different volume: %s: %s",
+				name, snap.SourceVolumeID)
+		}
+		if snap.Ready {
+			return snap, nil
+		}
+	}
+
+	vol, err := s.getVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotCloning(vol); err != nil {
+		return nil, err
+	}
+	if encrypted, _ := isEncrypted(vol.Parameters); encrypted {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"snapshots of encrypted volumes unsupported: %s", volumeID)
+	}
+
+	// A volume that may be written while its files are copied would not
+	// have a consistent snapshot.
+	if vol.sealed.IsZero() {
+		atts, err := s.store.listAttachments(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, att := range atts {
+			if !att.Readonly {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"volume is attached read-write: %s: node=%s",
+					volumeID, att.NodeID)
+			}
+		}
+	}
+
+	// Record the snapshot before its contents are copied so that an
+	// incomplete snapshot is known to not be ready.
+	snap = &Snapshot{
+		ID:             name,
+		SourceVolumeID: volumeID,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := s.store.saveSnapshot(ctx, snap); err != nil {
+		return nil, err
+	}
+
+	// Remove the contents of an earlier attempt and copy the volume.
+	snapPath := s.getSnapshotPath(name)
+	if err := os.RemoveAll(snapPath); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to remove snapshot: %s: %v", snapPath, err)
+	}
+	size, err := copyTree(ctx, vol.path, snapPath, nil, infoFileName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to copy volume: %s: %v", volumeID, err)
+	}
+
+	snap.SizeBytes = size
+	snap.Ready = true
+	if err := s.store.saveSnapshot(ctx, snap); err != nil {
+		return nil, err
+	}
+	log.WithFields(map[string]interface{}{
+		"snapshot": name,
+		"volume":   volumeID,
+		"size":     size,
+	}).Info("created snapshot")
+	return snap, nil
+}
+
+// VolumeSnapshots returns the snapshots of the volume with the specified
+// ID, or all of the snapshots if the ID is empty.
+func (s *service) VolumeSnapshots(
+	ctx context.Context, volumeID string) ([]*Snapshot, error) {
+
+	snaps, err := s.store.listSnapshots(ctx)
+	if err != nil || volumeID == "" {
+		return snaps, err
+	}
+	var matches []*Snapshot
+	for _, snap := range snaps {
+		if snap.SourceVolumeID == volumeID {
+			matches = append(matches, snap)
+		}
+	}
+	return matches, nil
+}
+
+// RemoveSnapshot removes the snapshot's contents and record. Removing a
+// snapshot that does not exist succeeds.
+func (s *service) RemoveSnapshot(ctx context.Context, id string) error {
+	if err := validateSnapshotID(id); err != nil {
+		return err
+	}
+	unlock, err := s.lockSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	snapPath := s.getSnapshotPath(id)
+	if err := os.RemoveAll(snapPath); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to remove snapshot: %s: %v", snapPath, err)
+	}
+	return s.store.deleteSnapshot(ctx, id)
+}
+
+// restoreSnapshot copies the contents of the snapshot to the directory
+// of a new volume. The snapshot's size may not exceed the volume's
+// capacity unless the capacity is zero.
+func (s *service) restoreSnapshot(
+	ctx context.Context, id, volPath string, capacityBytes int64) error {
+
+	if err := validateSnapshotID(id); err != nil {
+		return err
+	}
+	snap, err := s.store.getSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		return status.Errorf(codes.NotFound, "snapshot: %s", id)
+	}
+	if !snap.Ready {
+		return status.Errorf(codes.Unavailable, "snapshot not ready: %s", id)
+	}
+	if capacityBytes > 0 && snap.SizeBytes > capacityBytes {
+		return status.Errorf(codes.OutOfRange,
+			"snapshot size exceeds volume capacity: %d", snap.SizeBytes)
+	}
+	if _, err := copyTree(ctx, s.getSnapshotPath(id), volPath, nil); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to copy snapshot: %s: %v", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// storeFile is the name of the volume store that persists metadata
+	// in files alongside the volumes.
+	storeFile = "file"
+
+	// storeEtcd is the name of the volume store that persists metadata
+	// in etcd.
+	storeEtcd = "etcd"
+)
+
+// volumeStore persists the metadata of volumes and their attachments.
+type volumeStore interface {
+
+	// getVolume returns the volume with the specified ID. A nil value
+	// is returned if the volume does not exist.
+	getVolume(ctx context.Context, id string) (*volumeInfo, error)
+
+	// getVolumeID returns the ID of the volume with the specified name.
+	// An empty string is returned if the volume does not exist.
+	getVolumeID(ctx context.Context, name string) (string, error)
+
+	// createVolume atomically persists the record and name index of a
+	// new volume unless a volume with the same name exists. The existing
+	// volume is returned if a volume with the same name exists, otherwise
+	// a nil value is returned.
+	createVolume(ctx context.Context, vol *volumeInfo) (*volumeInfo, error)
+
+	// saveVolume persists the volume's record and name index.
+	saveVolume(ctx context.Context, vol *volumeInfo) error
+
+	// deleteVolume removes the volume's record and name index.
+	deleteVolume(ctx context.Context, id string) error
+
+	// listVolumes returns all of the volumes.
+	listVolumes(ctx context.Context) ([]*volumeInfo, error)
+
+	// getAttachment returns the record for the attachment of the
+	// specified volume to the specified node. A nil value is returned
+	// if the volume is not attached to the node.
+	getAttachment(
+		ctx context.Context, nodeID, volumeID string) (*attachmentInfo, error)
+
+	// saveAttachment persists the attachment record.
+	saveAttachment(ctx context.Context, att *attachmentInfo) error
+
+	// removeAttachments removes the records for the attachments of the
+	// specified volume. If nodeID is empty then the volume's attachments
+	// to all nodes are removed. The number of the volume's remaining
+	// attachments is returned.
+	removeAttachments(
+		ctx context.Context, nodeID, volumeID string) (int, error)
+
+	// listAttachments returns the records of the attachments of the
+	// specified volume.
+	listAttachments(
+		ctx context.Context, volumeID string) ([]*attachmentInfo, error)
+
+	// countAttachments returns the number of volumes attached to a node.
+	countAttachments(ctx context.Context, nodeID string) (int, error)
+
+	// getSnapshot returns the record of the snapshot with the specified
+	// ID. A nil value is returned if the snapshot does not exist.
+	getSnapshot(ctx context.Context, id string) (*Snapshot, error)
+
+	// saveSnapshot persists the snapshot's record.
+	saveSnapshot(ctx context.Context, snap *Snapshot) error
+
+	// deleteSnapshot removes the snapshot's record.
+	deleteSnapshot(ctx context.Context, id string) error
+
+	// listSnapshots returns the records of all of the snapshots.
+	listSnapshots(ctx context.Context) ([]*Snapshot, error)
+}
+
+// getVolume returns the volume with the specified ID or a NotFound
+// error if the volume does not exist.
+func (s *service) getVolume(
+	ctx context.Context, id string) (*volumeInfo, error) {
+
+	vol, err := s.store.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "volume: %s", id)
+	}
+	return vol, nil
+}
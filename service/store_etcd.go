@@ -0,0 +1,481 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csictx "github.com/rexray/gocsi/context"
+	etcdlock "github.com/rexray/gocsi/middleware/serialvolume/etcd"
+)
+
+// etcdStore is a volumeStore that persists the metadata of volumes and
+// their attachments in etcd. Multiple controllers configured with the
+// same endpoints and prefix share the same logical store.
+//
+// The keys are:
+//
+//	$prefix/volumes/$volumeID                    the volume's record
+//	$prefix/names/$volumeName                    the volume's ID
+//	$prefix/attachments/$nodeID/$volumeID        the attachment's record
+//	$prefix/volumeAttachments/$volumeID/$nodeID  the attachment's node ID
+//
+// Each request to etcd is limited by the store's timeout so that an
+// unreachable etcd fails the RPC instead of blocking it.
+type etcdStore struct {
+	client  *etcd.Client
+	prefix  string
+	vol     string
+	timeout time.Duration
+}
+
+// defaultEtcdRequestTimeout is the default timeout of a request to etcd.
+const defaultEtcdRequestTimeout = 10 * time.Second
+
+// getEtcdRequestTimeout returns the timeout of a request to etcd from
+// the environment variable X_CSI_VFS_ETCD_REQUEST_TIMEOUT.
+func getEtcdRequestTimeout(ctx context.Context) (time.Duration, error) {
+	v := csictx.Getenv(ctx, EnvVarEtcdRequestTimeout)
+	if v == "" {
+		return defaultEtcdRequestTimeout, nil
+	}
+	t, err := time.ParseDuration(v)
+	if err != nil || t <= 0 {
+		return 0, fmt.Errorf("invalid etcd request timeout: %s", v)
+	}
+	return t, nil
+}
+
+// withTimeout returns a context for a request to etcd that is canceled
+// when the store's timeout elapses.
+func (s *etcdStore) withTimeout(
+	ctx context.Context) (context.Context, context.CancelFunc) {
+
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// newEtcdClient returns a new etcd client and key prefix configured with
+// the environment variables X_CSI_VFS_ETCD_ENDPOINTS, X_CSI_VFS_ETCD_PREFIX,
+// and X_CSI_VFS_ETCD_DIAL_TIMEOUT.
+func newEtcdClient(ctx context.Context) (*etcd.Client, string, error) {
+
+	fields := map[string]interface{}{}
+	config := etcd.Config{}
+
+	endpoints := csictx.Getenv(ctx, EnvVarEtcdEndpoints)
+	if endpoints == "" {
+		endpoints = csictx.Getenv(ctx, etcdlock.EnvVarEndpoints)
+	}
+	if endpoints == "" {
+		return nil, "", status.Errorf(codes.FailedPrecondition,
+			"etcd requires %s", EnvVarEtcdEndpoints)
+	}
+	config.Endpoints = strings.Split(endpoints, ",")
+	fields["etcd.endpoints"] = endpoints
+
+	if v := csictx.Getenv(ctx, EnvVarEtcdDialTimeout); v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, "", err
+		}
+		config.DialTimeout = t
+		fields["etcd.dialTimeout"] = t
+	}
+
+	prefix := csictx.Getenv(ctx, EnvVarEtcdPrefix)
+	if prefix == "" {
+		prefix = "/csi-vfs"
+	}
+	prefix = path.Join("/", prefix)
+	fields["etcd.prefix"] = prefix
+
+	log.WithFields(fields).Info("creating etcd client")
+
+	client, err := etcd.New(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, prefix, nil
+}
+
+// getEtcdClient returns the service's etcd client and key prefix,
+// creating the client if necessary.
+func (s *service) getEtcdClient(
+	ctx context.Context) (*etcd.Client, string, error) {
+
+	if s.etcd == nil {
+		client, prefix, err := newEtcdClient(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		s.etcd, s.etcdPrefix = client, prefix
+	}
+	return s.etcd, s.etcdPrefix, nil
+}
+
+func (s *etcdStore) volumeKey(id string) string {
+	return path.Join(s.prefix, "volumes", id)
+}
+
+func (s *etcdStore) nameKey(name string) string {
+	return path.Join(s.prefix, "names", name)
+}
+
+func (s *etcdStore) attachmentKey(nodeID, volumeID string) string {
+	return path.Join(s.prefix, "attachments", nodeID, volumeID)
+}
+
+func (s *etcdStore) volumeAttachmentKey(volumeID, nodeID string) string {
+	return path.Join(s.prefix, "volumeAttachments", volumeID, nodeID)
+}
+
+func (s *etcdStore) snapshotKey(id string) string {
+	return path.Join(s.prefix, "snapshots", id)
+}
+
+func (s *etcdStore) getVolume(
+	ctx context.Context, id string) (*volumeInfo, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rep, err := s.client.Get(ctx, s.volumeKey(id))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to get volume: %s: %v", id, err)
+	}
+	if len(rep.Kvs) == 0 {
+		return nil, nil
+	}
+	return s.unmarshalVolume(id, rep.Kvs[0].Value)
+}
+
+func (s *etcdStore) unmarshalVolume(
+	id string, data []byte) (*volumeInfo, error) {
+
+	vol := &volumeInfo{path: path.Join(s.vol, id)}
+	if err := json.Unmarshal(data, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+func (s *etcdStore) getVolumeID(
+	ctx context.Context, name string) (string, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rep, err := s.client.Get(ctx, s.nameKey(name))
+	if err != nil {
+		return "", status.Errorf(codes.Unavailable,
+			"failed to get volume id: %s: %v", name, err)
+	}
+	if len(rep.Kvs) == 0 {
+		return "", nil
+	}
+	return string(rep.Kvs[0].Value), nil
+}
+
+// createVolume puts the volume's record and name index in a transaction
+// that only succeeds if the name index does not exist.
+func (s *etcdStore) createVolume(
+	ctx context.Context, vol *volumeInfo) (*volumeInfo, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	buf, err := json.Marshal(vol)
+	if err != nil {
+		return nil, err
+	}
+	id := path.Base(vol.path)
+	nameKey := s.nameKey(vol.Name)
+	rep, err := s.client.Txn(ctx).If(
+		etcd.Compare(etcd.CreateRevision(nameKey), "=", 0),
+	).Then(
+		etcd.OpPut(s.volumeKey(id), string(buf)),
+		etcd.OpPut(nameKey, id),
+	).Else(
+		etcd.OpGet(nameKey),
+	).Commit()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to create volume: %s: %v", id, err)
+	}
+	if rep.Succeeded {
+		return nil, nil
+	}
+
+	var existing *volumeInfo
+	if kvs := rep.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		if existing, err = s.getVolume(ctx, string(kvs[0].Value)); err != nil {
+			return nil, err
+		}
+	}
+	if existing == nil {
+		return nil, status.Errorf(codes.Aborted,
+			"volume deleted during create: %s", id)
+	}
+	return existing, nil
+}
+
+func (s *etcdStore) saveVolume(ctx context.Context, vol *volumeInfo) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	buf, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	id := path.Base(vol.path)
+	if _, err := s.client.Txn(ctx).Then(
+		etcd.OpPut(s.volumeKey(id), string(buf)),
+		etcd.OpPut(s.nameKey(vol.Name), id),
+	).Commit(); err != nil {
+		return status.Errorf(codes.Unavailable,
+			"failed to save volume: %s: %v", id, err)
+	}
+	return nil
+}
+
+func (s *etcdStore) deleteVolume(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	vol, err := s.getVolume(ctx, id)
+	if err != nil || vol == nil {
+		return err
+	}
+	if _, err := s.client.Txn(ctx).Then(
+		etcd.OpDelete(s.volumeKey(id)),
+		etcd.OpDelete(s.nameKey(vol.Name)),
+	).Commit(); err != nil {
+		return status.Errorf(codes.Unavailable,
+			"failed to delete volume: %s: %v", id, err)
+	}
+	return nil
+}
+
+func (s *etcdStore) listVolumes(ctx context.Context) ([]*volumeInfo, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	pfx := s.volumeKey("") + "/"
+	rep, err := s.client.Get(ctx, pfx, etcd.WithPrefix())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to list volumes: %v", err)
+	}
+	vols := make([]*volumeInfo, len(rep.Kvs))
+	for i, kv := range rep.Kvs {
+		id := strings.TrimPrefix(string(kv.Key), pfx)
+		vol, err := s.unmarshalVolume(id, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		vols[i] = vol
+	}
+	return vols, nil
+}
+
+func (s *etcdStore) getAttachment(
+	ctx context.Context, nodeID, volumeID string) (*attachmentInfo, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rep, err := s.client.Get(ctx, s.attachmentKey(nodeID, volumeID))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to get attachment: %s: %s: %v", nodeID, volumeID, err)
+	}
+	if len(rep.Kvs) == 0 {
+		return nil, nil
+	}
+	att := &attachmentInfo{}
+	if err := json.Unmarshal(rep.Kvs[0].Value, att); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal attachment: %s: %s: %v",
+			nodeID, volumeID, err)
+	}
+	return att, nil
+}
+
+func (s *etcdStore) saveAttachment(
+	ctx context.Context, att *attachmentInfo) error {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	buf, err := json.Marshal(att)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.Txn(ctx).Then(
+		etcd.OpPut(s.attachmentKey(att.NodeID, att.VolumeID), string(buf)),
+		etcd.OpPut(s.volumeAttachmentKey(att.VolumeID, att.NodeID), att.NodeID),
+	).Commit(); err != nil {
+		return status.Errorf(codes.Unavailable,
+			"failed to save attachment: %s: %s: %v",
+			att.NodeID, att.VolumeID, err)
+	}
+	return nil
+}
+
+func (s *etcdStore) removeAttachments(
+	ctx context.Context, nodeID, volumeID string) (int, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	pfx := s.volumeAttachmentKey(volumeID, "") + "/"
+	rep, err := s.client.Get(ctx, pfx, etcd.WithPrefix())
+	if err != nil {
+		return 0, status.Errorf(codes.Unavailable,
+			"failed to list attachments: %s: %v", volumeID, err)
+	}
+
+	var (
+		ops       []etcd.Op
+		remaining int
+	)
+	for _, kv := range rep.Kvs {
+		attNodeID := string(kv.Value)
+		if nodeID != "" && nodeID != attNodeID {
+			remaining++
+			continue
+		}
+		ops = append(ops,
+			etcd.OpDelete(s.attachmentKey(attNodeID, volumeID)),
+			etcd.OpDelete(s.volumeAttachmentKey(volumeID, attNodeID)))
+	}
+	if len(ops) == 0 {
+		return remaining, nil
+	}
+	if _, err := s.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return 0, status.Errorf(codes.Unavailable,
+			"failed to remove attachments: %s: %v", volumeID, err)
+	}
+	return remaining, nil
+}
+
+func (s *etcdStore) listAttachments(
+	ctx context.Context, volumeID string) ([]*attachmentInfo, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	pfx := s.volumeAttachmentKey(volumeID, "") + "/"
+	rep, err := s.client.Get(ctx, pfx, etcd.WithPrefix())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to list attachments: %s: %v", volumeID, err)
+	}
+	var atts []*attachmentInfo
+	for _, kv := range rep.Kvs {
+		att, err := s.getAttachment(ctx, string(kv.Value), volumeID)
+		if err != nil {
+			return nil, err
+		}
+		if att != nil {
+			atts = append(atts, att)
+		}
+	}
+	return atts, nil
+}
+
+func (s *etcdStore) countAttachments(
+	ctx context.Context, nodeID string) (int, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	pfx := s.attachmentKey(nodeID, "") + "/"
+	rep, err := s.client.Get(
+		ctx, pfx, etcd.WithPrefix(), etcd.WithCountOnly())
+	if err != nil {
+		return 0, status.Errorf(codes.Unavailable,
+			"failed to count attachments: %s: %v", nodeID, err)
+	}
+	return int(rep.Count), nil
+}
+
+func (s *etcdStore) getSnapshot(
+	ctx context.Context, id string) (*Snapshot, error) {
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rep, err := s.client.Get(ctx, s.snapshotKey(id))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to get snapshot: %s: %v", id, err)
+	}
+	if len(rep.Kvs) == 0 {
+		return nil, nil
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(rep.Kvs[0].Value, snap); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal snapshot: %s: %v", id, err)
+	}
+	return snap, nil
+}
+
+func (s *etcdStore) saveSnapshot(ctx context.Context, snap *Snapshot) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.Put(
+		ctx, s.snapshotKey(snap.ID), string(buf)); err != nil {
+		return status.Errorf(codes.Unavailable,
+			"failed to save snapshot: %s: %v", snap.ID, err)
+	}
+	return nil
+}
+
+func (s *etcdStore) deleteSnapshot(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.client.Delete(ctx, s.snapshotKey(id)); err != nil {
+		return status.Errorf(codes.Unavailable,
+			"failed to delete snapshot: %s: %v", id, err)
+	}
+	return nil
+}
+
+func (s *etcdStore) listSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rep, err := s.client.Get(
+		ctx, s.snapshotKey("")+"/", etcd.WithPrefix())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"failed to list snapshots: %v", err)
+	}
+	snaps := make([]*Snapshot, len(rep.Kvs))
+	for i, kv := range rep.Kvs {
+		snap := &Snapshot{}
+		if err := json.Unmarshal(kv.Value, snap); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to unmarshal snapshot: %s: %v", kv.Key, err)
+		}
+		snaps[i] = snap
+	}
+	return snaps, nil
+}
@@ -0,0 +1,389 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fileStore is a volumeStore that persists a volume's metadata in the
+// volume's info file, attachments in the attachments directory, and
+// snapshots in the snapshot records directory. The info file of an
+// encrypted volume is kept in the volume records directory instead of
+// the volume's directory, where it would be unreadable while the
+// volume's key is not added to its filesystem.
+type fileStore struct {
+	vol      string
+	volGlob  string
+	volInfo  string
+	att      string
+	snapInfo string
+}
+
+// getInfoPath returns the path of the info file of the volume with the
+// specified ID and parameters.
+func (s *fileStore) getInfoPath(id string, params map[string]string) string {
+	if encrypted, _ := isEncrypted(params); encrypted {
+		return path.Join(s.volInfo, id+".json")
+	}
+	return path.Join(s.vol, id, infoFileName)
+}
+
+func (s *fileStore) getVolume(
+	ctx context.Context, id string) (*volumeInfo, error) {
+
+	// Get the path of the volume and ensure it exists.
+	volPath := path.Join(s.vol, id)
+	if ok, err := fileExists(volPath); !ok {
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "%s: %v", volPath, err)
+		}
+		return nil, nil
+	}
+
+	// Get the path of the volume info file and ensure it exists. The
+	// info file of an encrypted volume is in the volume records
+	// directory.
+	volInfoPath := path.Join(volPath, infoFileName)
+	if ok, err := fileExists(volInfoPath); !ok {
+		if err != nil {
+			return nil, status.Errorf(
+				codes.NotFound, "%s: %v", volInfoPath, err)
+		}
+		volInfoPath = path.Join(s.volInfo, id+".json")
+		if ok, err := fileExists(volInfoPath); !ok {
+			if err != nil {
+				return nil, status.Errorf(
+					codes.NotFound, "%s: %v", volInfoPath, err)
+			}
+			return nil, nil
+		}
+	}
+
+	// Create a new volumeInfo object and try to unmarshal its contents
+	// from disk.
+	vol := &volumeInfo{path: volPath, infoPath: volInfoPath}
+	if err := vol.load(); err != nil {
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+// getVolumeID returns the name of the volume since a volume's directory
+// is named for both its ID and name.
+func (s *fileStore) getVolumeID(
+	ctx context.Context, name string) (string, error) {
+
+	vol, err := s.getVolume(ctx, name)
+	if err != nil || vol == nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// createVolume writes the volume's info file to a temporary file and
+// then links it to the info file's path. Linking fails if the info file
+// exists, so only one of several concurrent requests creates the volume,
+// and the info file is never observed partially written.
+func (s *fileStore) createVolume(
+	ctx context.Context, vol *volumeInfo) (*volumeInfo, error) {
+
+	id := path.Base(vol.path)
+	infoPath := s.getInfoPath(id, vol.Parameters)
+	f, err := ioutil.TempFile(path.Dir(infoPath), path.Base(infoPath))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to create volume info file: %s: %v", infoPath, err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	// TempFile creates the file readable only by its owner.
+	err = f.Chmod(0644)
+	if err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(vol)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to write volume info file: %s: %v", tmpPath, err)
+	}
+
+	if err := os.Link(tmpPath, infoPath); err != nil {
+		if !os.IsExist(err) {
+			return nil, status.Errorf(codes.Internal,
+				"failed to create volume info file: %s: %v", infoPath, err)
+		}
+		existing, err := s.getVolume(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, status.Errorf(codes.Aborted,
+				"volume deleted during create: %s", id)
+		}
+		return existing, nil
+	}
+
+	vol.infoPath = infoPath
+	return nil, nil
+}
+
+func (s *fileStore) saveVolume(ctx context.Context, vol *volumeInfo) error {
+	vol.infoPath = s.getInfoPath(path.Base(vol.path), vol.Parameters)
+	return vol.save()
+}
+
+func (s *fileStore) deleteVolume(ctx context.Context, id string) error {
+	for _, volInfoPath := range []string{
+		path.Join(s.vol, id, infoFileName),
+		path.Join(s.volInfo, id+".json"),
+	} {
+		err := os.Remove(volInfoPath)
+		if err != nil && !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal,
+				"failed to remove volume info file: %s: %v", volInfoPath, err)
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) listVolumes(ctx context.Context) ([]*volumeInfo, error) {
+	fileNames, err := filepath.Glob(s.volGlob)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to list volume dir: %s: %v", s.volGlob, err)
+	}
+	vols := make([]*volumeInfo, len(fileNames))
+	for i, volInfoPath := range fileNames {
+		vol := &volumeInfo{
+			path:     path.Dir(volInfoPath),
+			infoPath: volInfoPath,
+		}
+		if err := vol.load(); err != nil {
+			return nil, err
+		}
+		vols[i] = vol
+	}
+
+	// The info files of encrypted volumes are listed if the info files
+	// in their volume directories would match the glob.
+	glob := path.Join(s.volInfo, "*.json")
+	if fileNames, err = filepath.Glob(glob); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to list volume records dir: %s: %v", glob, err)
+	}
+	for _, volInfoPath := range fileNames {
+		volPath := path.Join(s.vol, strings.TrimSuffix(
+			path.Base(volInfoPath), ".json"))
+		if ok, _ := path.Match(
+			s.volGlob, path.Join(volPath, infoFileName)); !ok {
+			continue
+		}
+		vol := &volumeInfo{path: volPath, infoPath: volInfoPath}
+		if err := vol.load(); err != nil {
+			return nil, err
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+// getAttachmentPath returns the path of the record for the attachment
+// of the specified volume to the specified node.
+func (s *fileStore) getAttachmentPath(nodeID, volumeID string) string {
+	return path.Join(s.att, nodeID, volumeID+".json")
+}
+
+func (s *fileStore) getAttachment(
+	ctx context.Context, nodeID, volumeID string) (*attachmentInfo, error) {
+
+	attPath := s.getAttachmentPath(nodeID, volumeID)
+	f, err := os.Open(attPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to open attachment file: %s: %v", attPath, err)
+	}
+	defer f.Close()
+	att := &attachmentInfo{}
+	if err := json.NewDecoder(f).Decode(att); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal attachment: %s: %v", attPath, err)
+	}
+	return att, nil
+}
+
+func (s *fileStore) saveAttachment(
+	ctx context.Context, att *attachmentInfo) error {
+
+	nodeDir := path.Join(s.att, att.NodeID)
+	if err := os.MkdirAll(nodeDir, 0755); err != nil {
+		return status.Errorf(codes.Internal,
+			"mkdir failed: %s: %v", nodeDir, err)
+	}
+	attPath := s.getAttachmentPath(att.NodeID, att.VolumeID)
+	f, err := os.Create(attPath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to create attachment file: %s: %v", attPath, err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(att)
+}
+
+func (s *fileStore) removeAttachments(
+	ctx context.Context, nodeID, volumeID string) (int, error) {
+
+	if nodeID != "" {
+		attPath := s.getAttachmentPath(nodeID, volumeID)
+		if err := os.Remove(attPath); err != nil && !os.IsNotExist(err) {
+			return 0, status.Errorf(codes.Internal,
+				"failed to remove attachment file: %s: %v", attPath, err)
+		}
+	}
+	attPaths, err := filepath.Glob(s.getAttachmentPath("*", volumeID))
+	if err != nil {
+		return 0, status.Errorf(codes.Internal,
+			"failed to list attachments: %s: %v", volumeID, err)
+	}
+	if nodeID != "" {
+		return len(attPaths), nil
+	}
+	for _, attPath := range attPaths {
+		if err := os.Remove(attPath); err != nil && !os.IsNotExist(err) {
+			return 0, status.Errorf(codes.Internal,
+				"failed to remove attachment file: %s: %v", attPath, err)
+		}
+	}
+	return 0, nil
+}
+
+func (s *fileStore) listAttachments(
+	ctx context.Context, volumeID string) ([]*attachmentInfo, error) {
+
+	attPaths, err := filepath.Glob(s.getAttachmentPath("*", volumeID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to list attachments: %s: %v", volumeID, err)
+	}
+	var atts []*attachmentInfo
+	for _, attPath := range attPaths {
+		nodeID := path.Base(path.Dir(attPath))
+		att, err := s.getAttachment(ctx, nodeID, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		if att != nil {
+			atts = append(atts, att)
+		}
+	}
+	return atts, nil
+}
+
+func (s *fileStore) countAttachments(
+	ctx context.Context, nodeID string) (int, error) {
+
+	nodeDir := path.Join(s.att, nodeID)
+	fileInfos, err := ioutil.ReadDir(nodeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, status.Errorf(codes.Internal,
+			"failed to list attachments: %s: %v", nodeDir, err)
+	}
+	count := 0
+	for _, fi := range fileInfos {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".json") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// getSnapshotInfoPath returns the path of the record of the specified
+// snapshot. Records are kept apart from the snapshots' contents, whose
+// names may be any snapshot ID.
+func (s *fileStore) getSnapshotInfoPath(id string) string {
+	return path.Join(s.snapInfo, id+".json")
+}
+
+func (s *fileStore) getSnapshot(
+	ctx context.Context, id string) (*Snapshot, error) {
+
+	infoPath := s.getSnapshotInfoPath(id)
+	f, err := os.Open(infoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to open snapshot file: %s: %v", infoPath, err)
+	}
+	defer f.Close()
+	snap := &Snapshot{}
+	if err := json.NewDecoder(f).Decode(snap); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal snapshot: %s: %v", infoPath, err)
+	}
+	return snap, nil
+}
+
+func (s *fileStore) saveSnapshot(ctx context.Context, snap *Snapshot) error {
+	infoPath := s.getSnapshotInfoPath(snap.ID)
+	f, err := os.Create(infoPath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to create snapshot file: %s: %v", infoPath, err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+func (s *fileStore) deleteSnapshot(ctx context.Context, id string) error {
+	infoPath := s.getSnapshotInfoPath(id)
+	if err := os.Remove(infoPath); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal,
+			"failed to remove snapshot file: %s: %v", infoPath, err)
+	}
+	return nil
+}
+
+func (s *fileStore) listSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	infoPaths, err := filepath.Glob(s.getSnapshotInfoPath("*"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to list snapshots: %s: %v", s.snapInfo, err)
+	}
+	var snaps []*Snapshot
+	for _, infoPath := range infoPaths {
+		id := strings.TrimSuffix(path.Base(infoPath), ".json")
+		snap, err := s.getSnapshot(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if snap != nil {
+			snaps = append(snaps, snap)
+		}
+	}
+	return snaps, nil
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// attribSubdir is the volume attribute that specifies the template
+	// of the key of a target's subdirectory. A target is published as a
+	// bind mount of the volume's subdirectory with the key, instead of
+	// the volume's root directory. The template's ${name} references are
+	// replaced with the values of the volume attributes with the names.
+	attribSubdir = "subdir"
+
+	// paramSubdirPolicy is the CreateVolume parameter that specifies what
+	// happens to a subdirectory when the last target with its key is
+	// unpublished.
+	paramSubdirPolicy = "subdirPolicy"
+
+	// subdirArchivePrefix is the prefix of the name of an archived
+	// subdirectory.
+	subdirArchivePrefix = "archived-"
+)
+
+// subdirPolicy is the policy applied to a subdirectory when the last
+// target with its key is unpublished.
+type subdirPolicy string
+
+const (
+	// subdirRetain keeps the subdirectory so it is published to the
+	// next target with its key. This is the default policy.
+	subdirRetain subdirPolicy = "retain"
+
+	// subdirArchive renames the subdirectory so the next target with
+	// its key receives a new subdirectory.
+	subdirArchive subdirPolicy = "archive"
+
+	// subdirDelete removes the subdirectory.
+	subdirDelete subdirPolicy = "delete"
+)
+
+// getSubdirPolicy returns the subdirectory policy of a volume from the
+// CreateVolume parameters.
+func getSubdirPolicy(params map[string]string) (subdirPolicy, error) {
+	v, ok := params[paramSubdirPolicy]
+	if !ok || v == "" {
+		return subdirRetain, nil
+	}
+	switch p := subdirPolicy(v); p {
+	case subdirRetain, subdirArchive, subdirDelete:
+		return p, nil
+	}
+	return "", status.Errorf(codes.InvalidArgument,
+		"invalid param: %s=%s", paramSubdirPolicy, v)
+}
+
+// getSubdirKey returns the key of a target's subdirectory from the
+// template in the volume attributes. An empty key is returned if there
+// is no template. The key must be a clean, relative path after the
+// template is expanded, and it may not name the volume's info file.
+func getSubdirKey(attribs map[string]string) (string, error) {
+	tmpl, ok := attribs[attribSubdir]
+	if !ok || tmpl == "" {
+		return "", nil
+	}
+	var missing []string
+	key := os.Expand(tmpl, func(name string) string {
+		v, ok := attribs[name]
+		if !ok || v == "" {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid attribute: %s: missing attributes: %s",
+			attribSubdir, strings.Join(missing, ", "))
+	}
+	if err := validateSubdirKey(key); err != nil {
+		return "", status.Errorf(codes.InvalidArgument,
+			"invalid attribute: %s: %s: %v", attribSubdir, key, err)
+	}
+	return key, nil
+}
+
+// validateSubdirKey returns an error if the key is not a clean,
+// relative path or names the volume's info file.
+func validateSubdirKey(key string) error {
+	if path.IsAbs(key) {
+		return fmt.Errorf("path must be relative")
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("path must be clean and may not contain ..")
+		}
+	}
+	if strings.Split(key, "/")[0] == infoFileName {
+		return fmt.Errorf("path is reserved")
+	}
+	return nil
+}
+
+// mkSubdir creates the subdirectory with the key in the volume's root
+// directory if it does not exist and returns its path. New directories
+// have the owner and mode of the root directory. Each existing element
+// of the key must be a directory and not a symlink, so a workload may
+// not redirect another workload's target outside of the volume.
+func mkSubdir(root, key string) (string, error) {
+	dir := root
+	for _, part := range strings.Split(key, "/") {
+		dir = path.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return "", status.Errorf(codes.FailedPrecondition,
+					"subdir is not a directory: %s", dir)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return "", status.Errorf(codes.Internal,
+				"failed to stat subdir: %s: %v", dir, err)
+		}
+		if err := mkdirLike(dir, root); err != nil {
+			return "", status.Errorf(codes.Internal,
+				"failed to create subdir: %s: %v", dir, err)
+		}
+	}
+	return dir, nil
+}
+
+// isSubdirInUse returns true if the subdirectory with the key, or a
+// subdirectory nested in it, is one of the subdirectories with the keys
+// that are the sources of other targets.
+func isSubdirInUse(key string, keys []string) bool {
+	for _, k := range keys {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// applySubdirPolicy applies the volume's subdirectory policy to the
+// subdirectory with the key in the volume's directory after the last
+// target of the subdirectory, or of a subdirectory nested in it, is
+// unpublished. The policy is not applied to a
+// sealed volume, whose files may not change.
+func applySubdirPolicy(
+	ctx context.Context, vol *volumeInfo, volPath, key string) error {
+
+	if vol == nil || !vol.sealed.IsZero() {
+		return nil
+	}
+	policy, err := getSubdirPolicy(vol.Parameters)
+	if err != nil {
+		return err
+	}
+	if policy == subdirRetain {
+		return nil
+	}
+
+	// Ensure the subdirectory's path has not been redirected by a
+	// symlink since it was published.
+	dir := volPath
+	for _, part := range strings.Split(key, "/") {
+		dir = path.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to stat subdir: %s: %v", dir, err)
+		}
+		if !fi.IsDir() {
+			return status.Errorf(codes.FailedPrecondition,
+				"subdir is not a directory: %s", dir)
+		}
+	}
+
+	fields := map[string]interface{}{
+		"volume": vol.Name,
+		"subdir": key,
+		"policy": policy,
+	}
+	switch policy {
+	case subdirArchive:
+		archived, err := getSubdirArchivePath(dir)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(dir, archived); err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to archive subdir: %s: %v", dir, err)
+		}
+		fields["archived"] = archived
+	case subdirDelete:
+		if err := os.RemoveAll(dir); err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to delete subdir: %s: %v", dir, err)
+		}
+	}
+	log.WithFields(fields).Info("applied subdir policy")
+	return nil
+}
+
+// getSubdirArchivePath returns the path to which the subdirectory is
+// renamed when it is archived. The name has the subdirectory's name and
+// the current time, and a numeric suffix if a subdirectory with the same
+// name was already archived at the same time.
+func getSubdirArchivePath(dir string) (string, error) {
+	name := fmt.Sprintf("%s%s-%d", subdirArchivePrefix,
+		path.Base(dir), time.Now().Unix())
+	archived := path.Join(path.Dir(dir), name)
+	for i := 1; ; i++ {
+		_, err := os.Lstat(archived)
+		if os.IsNotExist(err) {
+			return archived, nil
+		}
+		if err != nil {
+			return "", status.Errorf(codes.Internal,
+				"failed to stat archived subdir: %s: %v", archived, err)
+		}
+		archived = path.Join(path.Dir(dir), fmt.Sprintf("%s-%d", name, i))
+	}
+}
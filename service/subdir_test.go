@@ -0,0 +1,25 @@
+package service
+
+import "testing"
+
+func TestIsSubdirInUse(t *testing.T) {
+	tests := []struct {
+		key  string
+		keys []string
+		want bool
+	}{
+		{"ns", nil, false},
+		{"ns", []string{"ns"}, true},
+		{"ns", []string{"ns/pod"}, true},
+		{"ns", []string{"ns/pod/data"}, true},
+		{"ns", []string{"ns2", "ns-pod", "other/ns"}, false},
+		{"ns/pod", []string{"ns"}, false},
+		{"ns/pod", []string{"ns/pod2", "ns/pod"}, true},
+	}
+	for _, tt := range tests {
+		if got := isSubdirInUse(tt.key, tt.keys); got != tt.want {
+			t.Errorf("isSubdirInUse(%q, %q) = %v, want %v",
+				tt.key, tt.keys, got, tt.want)
+		}
+	}
+}
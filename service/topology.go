@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// topologyParamPrefix is the prefix of the CreateVolume parameters
+	// that describe the topology from which a volume is accessible.
+	topologyParamPrefix = "topology."
+)
+
+// nodeInfo is the information a node service records about itself
+// in the nodes directory.
+type nodeInfo struct {
+	ID         string            `json:"id"`
+	Topology   map[string]string `json:"topology,omitempty"`
+	MaxVolumes int               `json:"max_volumes,omitempty"`
+}
+
+// parseTopology parses a comma-delimited list of key=value pairs.
+func parseTopology(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid topology label: %s", p)
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if k == "" {
+			return nil, fmt.Errorf("invalid topology label: %s", p)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// getTopologyParams returns the topology keys and values from the
+// CreateVolume parameters prefixed with "topology.".
+func getTopologyParams(params map[string]string) map[string]string {
+	var m map[string]string
+	for k, v := range params {
+		if !strings.HasPrefix(k, topologyParamPrefix) {
+			continue
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[strings.TrimPrefix(k, topologyParamPrefix)] = v
+	}
+	return m
+}
+
+// isTopologyCompatible returns an error if the node's topology labels
+// do not match all of the keys in the volume's accessible topology.
+func isTopologyCompatible(volTopo, nodeTopo map[string]string) error {
+	var keys []string
+	for k := range volTopo {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := nodeTopo[k]; !ok || v != volTopo[k] {
+			return status.Errorf(codes.FailedPrecondition,
+				"node topology mismatch: %s: vol=%s, node=%s",
+				k, volTopo[k], v)
+		}
+	}
+	return nil
+}
+
+// validateNodeID returns an error if the node ID cannot be used as the
+// name of a file in the nodes directory.
+func validateNodeID(nodeID string) error {
+	if nodeID == "" || nodeID == "." || nodeID == ".." ||
+		strings.ContainsRune(nodeID, '/') {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid node id: %q", nodeID)
+	}
+	return nil
+}
+
+// saveNode records this node's information in the nodes directory.
+func (s *service) saveNode() error {
+	node := nodeInfo{
+		ID:         s.nodeID,
+		Topology:   s.nodeTopology,
+		MaxVolumes: s.nodeMaxVolumes,
+	}
+	nodePath := path.Join(s.nodes, s.nodeID+".json")
+	f, err := os.Create(nodePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&node)
+}
+
+// getNode returns the information recorded by the node with the
+// specified ID. A nil value is returned if the node is unknown.
+func (s *service) getNode(nodeID string) (*nodeInfo, error) {
+	if err := validateNodeID(nodeID); err != nil {
+		return nil, err
+	}
+	nodePath := path.Join(s.nodes, nodeID+".json")
+	f, err := os.Open(nodePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Internal,
+			"failed to open node info file: %s: %v", nodePath, err)
+	}
+	defer f.Close()
+	node := &nodeInfo{}
+	if err := json.NewDecoder(f).Decode(node); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to unmarshal node: %s: %v", nodePath, err)
+	}
+	return node, nil
+}